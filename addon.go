@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Installs are recorded per world so that remove can undo exactly what install did
+const addonRecordFile = "mcpeserver-addons.json"
+
+// worldPackFiles maps a pack kind to the world file that activates its packs
+var worldPackFiles = map[string]string{
+	"behavior_packs": "world_behavior_packs.json",
+	"resource_packs": "world_resource_packs.json",
+}
+
+type addonPack struct {
+	UUID    string      `json:"uuid"`
+	Name    string      `json:"name"`
+	Version packVersion `json:"version"`
+	Kind    string      `json:"kind"`
+	Dir     string      `json:"dir"`
+}
+
+type addonRecord struct {
+	Name      string      `json:"name"`
+	Source    string      `json:"source"`
+	Installed string      `json:"installed"`
+	Packs     []addonPack `json:"packs"`
+}
+
+// profileLevelDir reads level-dir from <profile>.cfg, the world the server loads
+func profileLevelDir(profile string) string {
+	f, err := os.Open(profile + ".cfg")
+	if err != nil {
+		panic(fmt.Errorf("cannot find the world of profile %s (use -world): %v", profile, err))
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "level-dir=") {
+			return strings.Trim(strings.TrimPrefix(line, "level-dir="), "\"")
+		}
+	}
+	panic(fmt.Errorf("%s.cfg has no level-dir (use -world)", profile))
+}
+
+func worldPath(profile, world string) string {
+	if len(world) == 0 {
+		world = profileLevelDir(profile)
+	}
+	if len(world) == 0 || strings.ContainsAny(world, "/\\") || strings.HasPrefix(world, ".") {
+		panic(fmt.Errorf("invalid world name: %q", world))
+	}
+	return filepath.Join("worlds", world)
+}
+
+// unplacedModules are module types an addon may carry that have no place in a world
+var unplacedModules = map[string]string{
+	"skin_pack":      "skin packs are only used by clients",
+	"world_template": "world templates only create new worlds",
+}
+
+// packKindOf places a pack by its module types: resources go to resource_packs, data and scripts
+// to behavior_packs; skin packs and world templates keep their module type as kind
+func packKindOf(manifest packManifest) (string, error) {
+	kind := ""
+	for _, m := range manifest.Modules {
+		var next string
+		switch m.Type {
+		case "resources":
+			next = "resource_packs"
+		case "data", "script", "javascript", "client_data":
+			next = "behavior_packs"
+		case "skin_pack", "world_template":
+			next = m.Type
+		default:
+			return "", fmt.Errorf("unsupported module type %q", m.Type)
+		}
+		if len(kind) > 0 && kind != next {
+			return "", fmt.Errorf("mixes %s and %s modules", kind, next)
+		}
+		kind = next
+	}
+	if len(kind) == 0 {
+		return "", fmt.Errorf("has no modules")
+	}
+	return kind, nil
+}
+
+// expandNested extracts the .mcpack files an .mcaddon carries next to themselves
+func expandNested(root string, depth int) error {
+	var nested []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".mcpack", ".mcaddon", ".zip":
+			if info.Mode().IsRegular() {
+				nested = append(nested, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(nested) > 0 && depth == 0 {
+		return fmt.Errorf("archives nested too deeply: %s", nested[0])
+	}
+	for _, file := range nested {
+		dir := strings.TrimSuffix(file, filepath.Ext(file))
+		if _, err := os.Stat(dir); err == nil {
+			dir += ".d"
+		}
+		if err = extractZip(file, dir); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+		os.Remove(file)
+		if err = expandNested(dir, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findPacks returns the outermost directories below root that hold a manifest.json
+func findPacks(root string) ([]*pack, error) {
+	var packs []*pack
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(path, "manifest.json")); err != nil {
+			return nil
+		}
+		manifest, err := readPackManifest(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.TrimPrefix(path, root), err)
+		}
+		kind, err := packKindOf(manifest)
+		if err != nil {
+			return fmt.Errorf("pack %s %v", manifest.Header.Name, err)
+		}
+		if reason, ok := unplacedModules[kind]; ok {
+			printWarn(fmt.Sprintf("Skipping %s: %s", manifest.Header.Name, reason))
+			return filepath.SkipDir
+		}
+		packs = append(packs, &pack{manifest: manifest, dir: path, kind: kind, origin: "addon"})
+		return filepath.SkipDir
+	})
+	return packs, err
+}
+
+// orderPacks sorts the packs of an addon so that every pack comes after the packs it depends on,
+// and fails on dependencies neither the addon nor the world and built-in packs provide
+func orderPacks(packs []*pack, available *packCatalog) ([]*pack, error) {
+	byUUID := map[string]*pack{}
+	for _, p := range packs {
+		if _, dup := byUUID[p.uuid()]; dup {
+			return nil, fmt.Errorf("the addon contains uuid %s twice", p.uuid())
+		}
+		byUUID[p.uuid()] = p
+	}
+	var missing []string
+	var ordered []*pack
+	state := map[*pack]int{}
+	var visit func(p *pack) error
+	visit = func(p *pack) error {
+		switch state[p] {
+		case 1:
+			return fmt.Errorf("dependency cycle through %s", p.manifest.Header.Name)
+		case 2:
+			return nil
+		}
+		state[p] = 1
+		for _, dep := range p.manifest.Dependencies {
+			if len(dep.UUID) == 0 {
+				continue
+			}
+			if other, ok := byUUID[strings.ToLower(dep.UUID)]; ok {
+				if other.manifest.Header.Version.compare(dep.Version) < 0 {
+					missing = append(missing, fmt.Sprintf("%s needs %s %s, the addon has %s",
+						p.manifest.Header.Name, other.manifest.Header.Name, dep.Version, other.manifest.Header.Version))
+				}
+				if err := visit(other); err != nil {
+					return err
+				}
+			} else if !available.satisfied(dep) {
+				missing = append(missing, fmt.Sprintf("%s needs %s %s", p.manifest.Header.Name, dep.UUID, dep.Version))
+			}
+		}
+		state[p] = 2
+		ordered = append(ordered, p)
+		return nil
+	}
+	for _, p := range packs {
+		if err := visit(p); err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("unmet dependencies:\n\t%s", strings.Join(missing, "\n\t"))
+	}
+	return ordered, nil
+}
+
+func loadAddonRecords(world string) []addonRecord {
+	var records []addonRecord
+	data, err := ioutil.ReadFile(filepath.Join(world, addonRecordFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%s: %v", filepath.Join(world, addonRecordFile), err))
+	}
+	return records
+}
+
+func saveJSON(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// updateWorldPacks removes the given uuids from the world pack file of kind and puts add on top,
+// keeping every other entry (and any field we do not know about) as it was
+func updateWorldPacks(world, kind string, remove map[string]bool, add []addonPack) error {
+	file := filepath.Join(world, worldPackFiles[kind])
+	var entries []map[string]interface{}
+	if data, err := ioutil.ReadFile(file); err == nil {
+		if err = json.Unmarshal(stripJSONComments(data), &entries); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	result := []map[string]interface{}{}
+	for _, p := range add {
+		result = append(result, map[string]interface{}{"pack_id": p.UUID, "version": p.Version})
+	}
+	for _, entry := range entries {
+		id, _ := entry["pack_id"].(string)
+		if !remove[strings.ToLower(id)] {
+			result = append(result, entry)
+		}
+	}
+	return saveJSON(file, result)
+}
+
+var unsafeFolderChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func addonName(file string) string {
+	name := filepath.Base(file)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func addonInstall(profile, world, file string) {
+	worldDir := worldPath(profile, world)
+	name := addonName(file)
+	if err := os.MkdirAll(filepath.Dir(worldDir), 0755); err != nil {
+		panic(err)
+	}
+	staging := filepath.Join(filepath.Dir(worldDir), ".addon-"+unsafeFolderChars.ReplaceAllString(name, "_")+".tmp")
+	os.RemoveAll(staging)
+	defer os.RemoveAll(staging)
+	if err := extractZip(file, staging); err != nil {
+		panic(fmt.Errorf("%s: %v", file, err))
+	}
+	if err := expandNested(staging, 2); err != nil {
+		panic(fmt.Errorf("%s: %v", file, err))
+	}
+	packs, err := findPacks(staging)
+	if err != nil {
+		panic(fmt.Errorf("%s: %v", file, err))
+	}
+	if len(packs) == 0 {
+		panic(fmt.Errorf("%s contains no behavior or resource pack", file))
+	}
+
+	// a reinstall replaces the packs of the previous install of the same addon
+	records := loadAddonRecords(worldDir)
+	var previous *addonRecord
+	kept := []addonRecord{}
+	for i := range records {
+		if records[i].Name == name {
+			previous = &records[i]
+		} else {
+			kept = append(kept, records[i])
+		}
+	}
+	replaced := map[string]bool{}
+	if previous != nil {
+		for _, p := range previous.Packs {
+			replaced[p.Dir] = true
+		}
+	}
+	var existing []*pack
+	for _, kind := range packKinds {
+		for _, p := range scanPackDir(filepath.Join(worldDir, kind), kind, "world") {
+			if !replaced[p.dir] {
+				existing = append(existing, p)
+			}
+		}
+	}
+	catalog := newPackCatalog(append(existing, scanPacks("data", "")...))
+	for _, p := range packs {
+		for _, other := range catalog.byUUID[p.uuid()] {
+			if other.origin == "world" {
+				panic(fmt.Errorf("pack %s (%s) is already in the world at %s", p.manifest.Header.Name, p.uuid(), other.dir))
+			}
+		}
+	}
+	ordered, err := orderPacks(packs, catalog)
+	if err != nil {
+		panic(err)
+	}
+
+	// move the new packs next to where they go first, so a failure leaves the previous install alone
+	folders := make([]string, len(ordered))
+	staged := make([]string, len(ordered))
+	defer func() {
+		for _, dir := range staged {
+			if len(dir) > 0 {
+				os.RemoveAll(dir)
+			}
+		}
+	}()
+	for i, p := range ordered {
+		folder := filepath.Base(p.dir)
+		if p.dir == staging {
+			folder = name
+		}
+		folders[i] = unsafeFolderChars.ReplaceAllString(folder, "_")
+		// packs may share a folder name, the index and uuid keep their staging dirs apart
+		dir := filepath.Join(worldDir, p.kind, fmt.Sprintf(".addon-%d-%s.tmp", i, unsafeFolderChars.ReplaceAllString(p.uuid(), "_")))
+		os.RemoveAll(dir)
+		if err = os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			panic(err)
+		}
+		if err = os.Rename(p.dir, dir); err != nil {
+			panic(err)
+		}
+		staged[i] = dir
+	}
+
+	// the previous packs are only set aside until the new ones are in place, and put back if that fails
+	var retired addonRecord
+	var aside [][2]string
+	restore := func() {
+		for _, move := range aside {
+			if err := os.Rename(move[1], move[0]); err != nil {
+				printWarn(fmt.Sprintf("Failed to restore %s: %v", move[0], err))
+			}
+		}
+	}
+	if previous != nil {
+		printInfo(fmt.Sprintf("Replacing the previous install of %s", name))
+		retired = *previous
+		retired.Packs = append([]addonPack(nil), previous.Packs...)
+		for i, p := range retired.Packs {
+			if checkInside(worldDir, p.Dir) != nil {
+				// removeAddonPacks reports it
+				continue
+			}
+			dir := filepath.Join(filepath.Dir(p.Dir), fmt.Sprintf(".addon-old-%d.tmp", i))
+			os.RemoveAll(dir)
+			if err = os.Rename(p.Dir, dir); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				restore()
+				panic(err)
+			}
+			aside = append(aside, [2]string{p.Dir, dir})
+			retired.Packs[i].Dir = dir
+		}
+	}
+	record := addonRecord{Name: name, Source: filepath.Base(file), Installed: time.Now().Format(time.RFC3339)}
+	var placed []string
+	for i, p := range ordered {
+		target := filepath.Join(worldDir, p.kind, folders[i])
+		if _, err := os.Stat(target); err == nil {
+			target += "_" + strings.SplitN(p.uuid(), "-", 2)[0]
+		}
+		if err = os.Rename(staged[i], target); err != nil {
+			for _, dir := range placed {
+				os.RemoveAll(dir)
+			}
+			restore()
+			panic(err)
+		}
+		staged[i] = ""
+		placed = append(placed, target)
+		record.Packs = append(record.Packs, addonPack{UUID: p.uuid(), Name: p.manifest.Header.Name,
+			Version: p.manifest.Header.Version, Kind: p.kind, Dir: target})
+		printPair(p.kind, fmt.Sprintf("%s %s -> %s", p.manifest.Header.Name, p.manifest.Header.Version, target))
+	}
+	if previous != nil {
+		removeAddonPacks(worldDir, retired)
+	}
+	// dependents go above their dependencies so that they take precedence
+	for _, kind := range packKinds {
+		var add []addonPack
+		remove := map[string]bool{}
+		for i := len(record.Packs) - 1; i >= 0; i-- {
+			if p := record.Packs[i]; p.Kind == kind {
+				add = append(add, p)
+				remove[p.UUID] = true
+			}
+		}
+		if len(add) == 0 {
+			continue
+		}
+		if err = updateWorldPacks(worldDir, kind, remove, add); err != nil {
+			panic(err)
+		}
+	}
+	if err = saveJSON(filepath.Join(worldDir, addonRecordFile), append(kept, record)); err != nil {
+		panic(err)
+	}
+	printPair("Installed", fmt.Sprintf("%s (%d packs) into %s", name, len(record.Packs), worldDir))
+}
+
+// removeAddonPacks deletes the pack folders of an install and deactivates them
+func removeAddonPacks(world string, record addonRecord) {
+	for _, kind := range packKinds {
+		remove := map[string]bool{}
+		for _, p := range record.Packs {
+			if p.Kind == kind {
+				remove[p.UUID] = true
+			}
+		}
+		if len(remove) == 0 {
+			continue
+		}
+		if err := updateWorldPacks(world, kind, remove, nil); err != nil {
+			panic(err)
+		}
+	}
+	for _, p := range record.Packs {
+		if err := checkInside(world, p.Dir); err != nil {
+			printWarn(fmt.Sprintf("Not removing %s: %v", p.Dir, err))
+			continue
+		}
+		if err := os.RemoveAll(p.Dir); err != nil {
+			printWarn(fmt.Sprintf("Failed to remove %s: %v", p.Dir, err))
+		}
+	}
+}
+
+func addonRemove(profile, world, name string, force bool) {
+	worldDir := worldPath(profile, world)
+	records := loadAddonRecords(worldDir)
+	kept := []addonRecord{}
+	var found *addonRecord
+	for i := range records {
+		match := records[i].Name == name
+		for _, p := range records[i].Packs {
+			match = match || p.UUID == strings.ToLower(name)
+		}
+		if match && found == nil {
+			found = &records[i]
+		} else {
+			kept = append(kept, records[i])
+		}
+	}
+	if found == nil {
+		panic(fmt.Errorf("no addon %s installed in %s", name, worldDir))
+	}
+	removing := map[string]bool{}
+	for _, p := range found.Packs {
+		removing[p.UUID] = true
+	}
+	if !force {
+		var dependents []string
+		for _, kind := range packKinds {
+			for _, p := range scanPackDir(filepath.Join(worldDir, kind), kind, "world") {
+				if removing[p.uuid()] {
+					continue
+				}
+				for _, dep := range p.manifest.Dependencies {
+					if removing[strings.ToLower(dep.UUID)] {
+						dependents = append(dependents, p.manifest.Header.Name)
+					}
+				}
+			}
+		}
+		if len(dependents) > 0 {
+			panic(fmt.Errorf("%s is needed by %s (use -force to remove anyway)", found.Name, strings.Join(dependents, ", ")))
+		}
+	}
+	removeAddonPacks(worldDir, *found)
+	if err := saveJSON(filepath.Join(worldDir, addonRecordFile), kept); err != nil {
+		panic(err)
+	}
+	printPair("Removed", fmt.Sprintf("%s (%d packs) from %s", found.Name, len(found.Packs), worldDir))
+}
+
+func addonList(profile, world string) {
+	worldDir := worldPath(profile, world)
+	active := map[string]bool{}
+	for _, kind := range packKinds {
+		var entries []struct {
+			PackID string `json:"pack_id"`
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(worldDir, worldPackFiles[kind])); err == nil {
+			json.Unmarshal(stripJSONComments(data), &entries)
+		}
+		for _, entry := range entries {
+			active[strings.ToLower(entry.PackID)] = true
+		}
+	}
+	records := loadAddonRecords(worldDir)
+	for _, record := range records {
+		printPair(record.Name, fmt.Sprintf("%s, installed %s", record.Source, record.Installed))
+		for _, p := range record.Packs {
+			fmt.Printf("    %-36s  %-8s  %-8s  %s\n", p.UUID, p.Version, strings.TrimSuffix(p.Kind, "_packs"), p.Name)
+			if !active[p.UUID] {
+				printWarn(fmt.Sprintf("    not enabled in %s", worldPackFiles[p.Kind]))
+			}
+			if _, err := os.Stat(p.Dir); err != nil {
+				printWarn(fmt.Sprintf("    %s is missing", p.Dir))
+			}
+		}
+	}
+	if len(records) == 0 {
+		printInfo(fmt.Sprintf("No addons installed in %s", worldDir))
+	}
+}
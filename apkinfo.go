@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+type apkInfo struct {
+	Package     string   `json:"package"`
+	VersionName string   `json:"versionName"`
+	VersionCode int64    `json:"versionCode"`
+	Split       string   `json:"split,omitempty"`
+	ABIs        []string `json:"abis"`
+}
+
+// Chunk types of Android's binary XML (AXML) format, see ResourceTypes.h in the AOSP sources
+const (
+	axmlStringPool   = 0x0001
+	axmlFile         = 0x0003
+	axmlResourceMap  = 0x0180
+	axmlStartElement = 0x0102
+	axmlUTF8Flag     = 1 << 8
+
+	axmlTypeReference = 0x01
+	axmlTypeString    = 0x03
+	axmlTypeIntDec    = 0x10
+	axmlTypeIntHex    = 0x11
+)
+
+// android attributes are often stripped down to their resource id, so keep the ones we need
+var axmlAttributeIDs = map[uint32]string{
+	0x0101021b: "versionCode",
+	0x0101021c: "versionName",
+}
+
+type axmlAttribute struct {
+	name     string
+	raw      string
+	dataType uint8
+	data     uint32
+}
+
+func (attr axmlAttribute) String() string {
+	switch attr.dataType {
+	case axmlTypeString:
+		return attr.raw
+	case axmlTypeIntDec, axmlTypeIntHex:
+		return fmt.Sprint(int32(attr.data))
+	case axmlTypeReference:
+		return fmt.Sprintf("@0x%08x", attr.data)
+	}
+	if len(attr.raw) > 0 {
+		return attr.raw
+	}
+	return fmt.Sprint(attr.data)
+}
+
+func readStringPool(chunk []byte) ([]string, error) {
+	if len(chunk) < 28 {
+		return nil, errors.New("truncated string pool")
+	}
+	le := binary.LittleEndian
+	count := le.Uint32(chunk[8:])
+	flags := le.Uint32(chunk[16:])
+	start := le.Uint32(chunk[20:])
+	headerSize := uint32(le.Uint16(chunk[2:]))
+	if uint64(headerSize)+uint64(count)*4 > uint64(len(chunk)) || uint64(start) > uint64(len(chunk)) {
+		return nil, errors.New("malformed string pool")
+	}
+	result := make([]string, count)
+	for i := range result {
+		offset := uint64(start) + uint64(le.Uint32(chunk[uint64(headerSize)+uint64(i)*4:]))
+		if offset >= uint64(len(chunk)) {
+			return nil, errors.New("string offset out of range")
+		}
+		data := chunk[offset:]
+		if flags&axmlUTF8Flag != 0 {
+			// utf-16 length then utf-8 length, each one or two bytes
+			skip := func() (int, bool) {
+				if len(data) < 1 {
+					return 0, false
+				}
+				n := int(data[0])
+				if n&0x80 != 0 {
+					if len(data) < 2 {
+						return 0, false
+					}
+					n = (n&0x7f)<<8 | int(data[1])
+					data = data[2:]
+				} else {
+					data = data[1:]
+				}
+				return n, true
+			}
+			_, ok1 := skip()
+			n, ok2 := skip()
+			if !ok1 || !ok2 || n > len(data) {
+				return nil, errors.New("malformed utf-8 string")
+			}
+			result[i] = string(data[:n])
+		} else {
+			if len(data) < 2 {
+				return nil, errors.New("malformed utf-16 string")
+			}
+			n := int(le.Uint16(data))
+			data = data[2:]
+			if n&0x8000 != 0 {
+				if len(data) < 2 {
+					return nil, errors.New("malformed utf-16 string")
+				}
+				n = (n&0x7fff)<<16 | int(le.Uint16(data))
+				data = data[2:]
+			}
+			// n goes up to 2^31-1, doubling it overflows int on 32-bit platforms
+			if uint64(n)*2 > uint64(len(data)) {
+				return nil, errors.New("malformed utf-16 string")
+			}
+			units := make([]uint16, n)
+			for j := range units {
+				units[j] = le.Uint16(data[j*2:])
+			}
+			result[i] = string(utf16.Decode(units))
+		}
+	}
+	return result, nil
+}
+
+// parseManifestAttributes returns the attributes of the root <manifest> element of an AXML document
+func parseManifestAttributes(data []byte) (map[string]axmlAttribute, error) {
+	le := binary.LittleEndian
+	if len(data) < 8 || le.Uint16(data) != axmlFile {
+		return nil, errors.New("not a binary xml file")
+	}
+	var pool []string
+	var resourceIDs []uint32
+	str := func(index uint32) string {
+		if index < uint32(len(pool)) {
+			return pool[index]
+		}
+		return ""
+	}
+	for offset := uint32(le.Uint16(data[2:])); offset+8 <= uint32(len(data)); {
+		chunkType := le.Uint16(data[offset:])
+		headerSize := uint32(le.Uint16(data[offset+2:]))
+		size := le.Uint32(data[offset+4:])
+		if size < 8 || uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, errors.New("malformed chunk")
+		}
+		chunk := data[offset : offset+size]
+		offset += size
+		switch chunkType {
+		case axmlStringPool:
+			var err error
+			if pool, err = readStringPool(chunk); err != nil {
+				return nil, err
+			}
+		case axmlResourceMap:
+			for i := headerSize; i+4 <= size; i += 4 {
+				resourceIDs = append(resourceIDs, le.Uint32(chunk[i:]))
+			}
+		case axmlStartElement:
+			if size < headerSize+20 {
+				return nil, errors.New("truncated element")
+			}
+			ext := chunk[headerSize:]
+			if str(le.Uint32(ext[4:])) != "manifest" {
+				return nil, errors.New("root element is not <manifest>")
+			}
+			attrStart := uint32(le.Uint16(ext[8:]))
+			attrSize := uint32(le.Uint16(ext[10:]))
+			attrCount := uint32(le.Uint16(ext[12:]))
+			if attrSize < 20 || uint64(headerSize)+uint64(attrStart)+uint64(attrSize)*uint64(attrCount) > uint64(size) {
+				return nil, errors.New("malformed attributes")
+			}
+			result := make(map[string]axmlAttribute)
+			for i := uint32(0); i < attrCount; i++ {
+				raw := ext[attrStart+i*attrSize:]
+				nameIndex := le.Uint32(raw[4:])
+				attr := axmlAttribute{
+					name:     str(nameIndex),
+					dataType: raw[15],
+					data:     le.Uint32(raw[16:]),
+				}
+				if rawIndex := le.Uint32(raw[8:]); rawIndex != 0xffffffff {
+					attr.raw = str(rawIndex)
+				}
+				if nameIndex < uint32(len(resourceIDs)) {
+					if name, ok := axmlAttributeIDs[resourceIDs[nameIndex]]; ok {
+						attr.name = name
+					}
+				}
+				result[attr.name] = attr
+			}
+			return result, nil
+		}
+	}
+	return nil, errors.New("no <manifest> element")
+}
+
+func readAPKInfo(r *zip.Reader) (apkInfo, error) {
+	info := apkInfo{}
+	abis := map[string]bool{}
+	var manifest *zip.File
+	for _, f := range r.File {
+		if f.Name == "AndroidManifest.xml" {
+			manifest = f
+		}
+		if parts := strings.Split(f.Name, "/"); len(parts) == 3 && parts[0] == "lib" && strings.HasSuffix(parts[2], ".so") {
+			abis[parts[1]] = true
+		}
+	}
+	for abi := range abis {
+		info.ABIs = append(info.ABIs, abi)
+	}
+	sort.Strings(info.ABIs)
+	if manifest == nil {
+		return info, errors.New("no AndroidManifest.xml")
+	}
+	rc, err := manifest.Open()
+	if err != nil {
+		return info, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return info, err
+	}
+	attrs, err := parseManifestAttributes(data)
+	if err != nil {
+		return info, fmt.Errorf("AndroidManifest.xml: %v", err)
+	}
+	if attr, ok := attrs["package"]; ok {
+		info.Package = attr.String()
+	}
+	if attr, ok := attrs["versionName"]; ok {
+		info.VersionName = attr.String()
+	}
+	if attr, ok := attrs["versionCode"]; ok {
+		info.VersionCode = int64(attr.data)
+	}
+	if attr, ok := attrs["split"]; ok {
+		info.Split = attr.String()
+	}
+	return info, nil
+}
+
+func (info apkInfo) hasABI(abi string) bool {
+	for _, a := range info.ABIs {
+		if a == abi {
+			return true
+		}
+	}
+	return false
+}
+
+// coreExpectedVersion is the game version the installed core was built for: bin/version if the core
+// ships one, otherwise the name of the managed version in use
+func coreExpectedVersion() string {
+	if data, err := ioutil.ReadFile(filepath.Join("bin", "version")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return currentVersion("core")
+}
+
+// versionMatches reports whether version starts with every numeric component of expected
+func versionMatches(version, expected string) bool {
+	ev, v := parseVersion(expected), parseVersion(version)
+	if len(ev) > len(v) {
+		return false
+	}
+	for i := range ev {
+		if ev[i] != v[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (info apkInfo) print() {
+	printPair("Package", info.Package)
+	printPair("Version", fmt.Sprintf("%s (%d)", info.VersionName, info.VersionCode))
+	if len(info.Split) > 0 {
+		printPair("Split", info.Split)
+	}
+	printPair("ABIs", strings.Join(info.ABIs, ", "))
+}
+
+// checkAPK prints the apk metadata and refuses apks the x86 core cannot load
+func checkAPK(info apkInfo) {
+	info.print()
+	if !info.hasABI("x86") {
+		found := strings.Join(info.ABIs, ", ")
+		if len(found) == 0 {
+			found = "none"
+		}
+		panic(withCode("no_x86_abi", fmt.Errorf("apk has no x86 native libraries (found: %s), the server core can only load x86", found)))
+	}
+	expected := coreExpectedVersion()
+	if len(expected) > 0 && expected[0] >= '0' && expected[0] <= '9' && !versionMatches(info.VersionName, expected) {
+		printWarn(fmt.Sprintf("The installed core expects version %s, this apk is %s", expected, info.VersionName))
+	}
+}
+
+func apkinfo(file, format string) {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	info, err := readAPKInfo(&r.Reader)
+	if err != nil {
+		panic(err)
+	}
+	switch format {
+	case "text":
+		info.print()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+	default:
+		panic(fmt.Errorf("unknown output format: %s", format))
+	}
+}
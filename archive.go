@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unsafeEntryError names the archive entry that was refused and why
+type unsafeEntryError struct {
+	entry  string
+	reason string
+}
+
+func (e unsafeEntryError) Error() string {
+	return fmt.Sprintf("unsafe archive entry %q: %s", e.entry, e.reason)
+}
+
+// archiveTarget resolves an archive entry below base, refusing names that are absolute,
+// contain ".." parts or could be read differently on another platform
+func archiveTarget(base, name string) (string, error) {
+	switch {
+	case len(name) == 0:
+		return "", unsafeEntryError{name, "empty name"}
+	case strings.ContainsRune(name, 0):
+		return "", unsafeEntryError{name, "NUL in name"}
+	case strings.ContainsRune(name, '\\'):
+		return "", unsafeEntryError{name, "backslash in name"}
+	case strings.HasPrefix(name, "/") || filepath.IsAbs(name) || (len(name) > 1 && name[1] == ':'):
+		return "", unsafeEntryError{name, "absolute path"}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", unsafeEntryError{name, "parent directory reference"}
+		}
+	}
+	target := filepath.Join(base, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(base, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", unsafeEntryError{name, "escapes target"}
+	}
+	return target, nil
+}
+
+// checkZipEntry refuses everything but plain files and directories
+func checkZipEntry(f *zip.File) error {
+	mode := f.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return unsafeEntryError{f.Name, "symlink"}
+	case mode&(os.ModeDevice|os.ModeCharDevice) != 0:
+		return unsafeEntryError{f.Name, "device file"}
+	case mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeIrregular) != 0:
+		return unsafeEntryError{f.Name, "special file"}
+	case mode.IsDir() != strings.HasSuffix(f.Name, "/"):
+		return unsafeEntryError{f.Name, "directory flag does not match name"}
+	}
+	return nil
+}
+
+// entryMode ignores the archive-supplied permissions except for the executable bit
+func entryMode(f *zip.File) os.FileMode {
+	if f.Mode().IsDir() || f.Mode()&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+// checkInside makes sure no symlink already on disk redirects path out of base
+func checkInside(base, path string) error {
+	root, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Lstat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves outside of %s", path, base)
+	}
+	return nil
+}
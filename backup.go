@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// holdSave stops the server from writing the world and returns the files to copy with the length
+// each must be truncated to; an empty map means the whole world directory
+func holdSave(b bus) (map[string]int64, error) {
+	if _, err := b.exec("save hold"); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 30; i++ {
+		time.Sleep(time.Second)
+		result, err := b.exec("save query")
+		if err != nil {
+			return nil, err
+		}
+		if files, ready := parseSaveQuery(stripANSI(result)); ready {
+			return files, nil
+		}
+	}
+	return nil, fmt.Errorf("the server did not get the world ready for copying within 30s")
+}
+
+// parseSaveQuery reads the "world/db/000005.ldb:1234, ..." list that follows the line saying the
+// files are ready to be copied; names may contain colons and spaces, the length is after the last colon
+func parseSaveQuery(result string) (map[string]int64, bool) {
+	lines := strings.Split(result, "\n")
+	for i, line := range lines {
+		if !strings.Contains(strings.ToLower(line), "ready") {
+			continue
+		}
+		files := map[string]int64{}
+		for _, item := range strings.Split(strings.Join(lines[i+1:], "\n"), ", ") {
+			item = strings.TrimSpace(item)
+			sep := strings.LastIndex(item, ":")
+			if sep <= 0 {
+				continue
+			}
+			size, err := strconv.ParseInt(item[sep+1:], 10, 64)
+			if err != nil || size < 0 {
+				continue
+			}
+			files[item[:sep]] = size
+		}
+		return files, true
+	}
+	return nil, false
+}
+
+func addBackupFile(w *zip.Writer, path, name string, limit int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Deflate
+	out, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader = in
+	if limit >= 0 {
+		reader = io.LimitReader(in, limit)
+	}
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+// backupWorld zips the profile's world into dir while saving is on hold and keeps the newest keep archives
+func backupWorld(profile string, b bus, dir string, keep int) (string, error) {
+	world := worldPath(profile, "")
+	name := filepath.Base(world)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	files, err := holdSave(b)
+	defer b.exec("save resume")
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, fmt.Sprintf("%s-%s.zip", name, time.Now().Format("20060102-150405")))
+	tmp := target + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	w := zip.NewWriter(out)
+	if len(files) > 0 {
+		for file, size := range files {
+			// save query names files relative to the worlds directory, starting with the world itself
+			rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(file)), name+"/")
+			if _, err = archiveTarget(world, rel); err != nil {
+				break
+			}
+			if err = addBackupFile(w, filepath.Join(world, rel), filepath.Join(name, rel), size); err != nil {
+				break
+			}
+		}
+	} else {
+		err = filepath.Walk(world, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(world), path)
+			if err != nil {
+				return err
+			}
+			return addBackupFile(w, path, rel, -1)
+		})
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	pruneBackups(dir, name, keep)
+	return target, nil
+}
+
+// pruneBackups removes all but the newest keep archives of the world, keep <= 0 keeps everything
+func pruneBackups(dir, name string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, name+"-*.zip"))
+	// the timestamp in the name sorts chronologically
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			printWarn(fmt.Sprintf("Failed to remove old backup %s: %v", matches[0], err))
+		}
+		matches = matches[1:]
+	}
+}
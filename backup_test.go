@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSaveQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		result string
+		files  map[string]int64
+		ready  bool
+	}{
+		{"not ready", "A previous save has not been completed.", nil, false},
+		{"ready", "Data saved. Files are now ready to be copied.\nworld/db/000005.ldb:1234, world/level.dat:2048",
+			map[string]int64{"world/db/000005.ldb": 1234, "world/level.dat": 2048}, true},
+		{"colons and spaces in names", "Data saved. Files are now ready to be copied.\nmy world: 2/db/CURRENT:16, my world: 2/levelname.txt:9\n",
+			map[string]int64{"my world: 2/db/CURRENT": 16, "my world: 2/levelname.txt": 9}, true},
+		{"nothing before the ready line counts", "Saving: 1/2\nData saved. Files are now ready to be copied.\nworld/level.dat:10",
+			map[string]int64{"world/level.dat": 10}, true},
+		{"malformed items are left out", "Files are now ready to be copied.\nworld/a, world/b:x, world/c:3",
+			map[string]int64{"world/c": 3}, true},
+	}
+	for _, test := range tests {
+		files, ready := parseSaveQuery(test.result)
+		if ready != test.ready || !reflect.DeepEqual(files, test.files) {
+			t.Errorf("%s: got %v (%v), want %v (%v)", test.name, files, ready, test.files, test.ready)
+		}
+	}
+}
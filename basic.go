@@ -2,16 +2,63 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"regexp"
+	"strings"
 )
 
+var ansiPattern = regexp.MustCompile("\033\\[[0-9;]*[a-zA-Z]")
+
+func stripANSI(text string) string {
+	return ansiPattern.ReplaceAllString(text, "")
+}
+
+// stringList is a flag that may be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func printInfo(item string) {
-	fmt.Printf("\033[0;32m%s\033[0m\n", item)
+	switch output {
+	case outputJSON:
+		emit(event{Event: "info", Message: item})
+	case outputPlain:
+		fmt.Println(item)
+	default:
+		fmt.Printf("\033[0;32m%s\033[0m\n", item)
+	}
 }
 
 func printWarn(item string) {
-	fmt.Printf("\033[0;91m%s\033[0m\n", item)
+	switch output {
+	case outputJSON:
+		emit(event{Event: "warning", Message: item})
+	case outputPlain:
+		fmt.Println(item)
+	default:
+		fmt.Printf("\033[0;91m%s\033[0m\n", item)
+	}
 }
 
 func printPair(key string, value string) {
-	fmt.Printf("\033[0;34m%s: \033[0;35m%s\033[0m\n", key, value)
+	switch output {
+	case outputJSON:
+		emit(event{Event: "info", Key: key, Value: value})
+	case outputPlain:
+		fmt.Printf("%s: %s\n", key, value)
+	default:
+		fmt.Printf("\033[0;34m%s: \033[0;35m%s\033[0m\n", key, value)
+	}
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// apkSource is one apk of a (possibly split) installation
+type apkSource struct {
+	name   string
+	reader *zip.Reader
+	info   apkInfo
+}
+
+// apkBundle merges the base apk and its config splits, given as separate files or packed
+// in an .apks/.xapk bundle
+type apkBundle struct {
+	sources []*apkSource
+	closers []io.Closer
+	temps   []string
+}
+
+// apkEntry is a file of the bundle together with the apk it comes from
+type apkEntry struct {
+	source *apkSource
+	file   *zip.File
+	target string
+}
+
+func (b *apkBundle) close() {
+	for _, c := range b.closers {
+		c.Close()
+	}
+	for _, t := range b.temps {
+		os.Remove(t)
+	}
+}
+
+func isAPK(r *zip.Reader) bool {
+	for _, f := range r.File {
+		if f.Name == "AndroidManifest.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *apkBundle) add(name string, r *zip.Reader) {
+	info, err := readAPKInfo(r)
+	if err != nil {
+		panic(withCode("apk_manifest", fmt.Errorf("%s: %v", name, err)))
+	}
+	b.sources = append(b.sources, &apkSource{name: name, reader: r, info: info})
+}
+
+// addNested copies an apk stored inside a bundle to a temporary file so it can be read randomly
+func (b *apkBundle) addNested(bundle string, f *zip.File) {
+	rc, err := f.Open()
+	if err != nil {
+		panic(err)
+	}
+	defer rc.Close()
+	tmp, err := ioutil.TempFile("", "mcpeserver-split-")
+	if err != nil {
+		panic(err)
+	}
+	b.temps = append(b.temps, tmp.Name())
+	if _, err = io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		panic(err)
+	}
+	tmp.Close()
+	r, err := zip.OpenReader(tmp.Name())
+	if err != nil {
+		panic(withCode("apk_open", fmt.Errorf("%s/%s: %v", bundle, f.Name, err)))
+	}
+	b.closers = append(b.closers, r)
+	b.add(bundle+"/"+f.Name, &r.Reader)
+}
+
+func openBundle(files []string) *apkBundle {
+	b := &apkBundle{}
+	ok := false
+	defer func() {
+		if !ok {
+			b.close()
+		}
+	}()
+	for _, file := range files {
+		r, err := zip.OpenReader(file)
+		if err != nil {
+			panic(withCode("apk_open", err))
+		}
+		b.closers = append(b.closers, r)
+		if isAPK(&r.Reader) {
+			b.add(file, &r.Reader)
+			continue
+		}
+		// bundletool keeps the splits in splits/ and whole per-ABI apks for old devices in
+		// standalones/, the latter only stand in when there are no splits
+		var nested, standalones []*zip.File
+		for _, f := range r.File {
+			if path.Ext(f.Name) != ".apk" || f.FileInfo().IsDir() {
+				continue
+			}
+			err := checkZipEntry(f)
+			if err == nil {
+				_, err = archiveTarget(".", f.Name)
+			}
+			if err != nil {
+				panic(withCode("unsafe_entry", fmt.Errorf("%s: %v", file, err)))
+			}
+			if strings.HasPrefix(f.Name, "standalones/") {
+				standalones = append(standalones, f)
+			} else {
+				nested = append(nested, f)
+			}
+		}
+		if len(nested) == 0 {
+			nested = standalones
+		}
+		for _, f := range nested {
+			b.addNested(file, f)
+		}
+		if len(nested) == 0 {
+			panic(withCode("apk_open", fmt.Errorf("%s is neither an apk nor a bundle of apks", file)))
+		}
+	}
+	ok = true
+	return b
+}
+
+// info describes the bundle as a whole: the base apk's metadata with the ABIs of all splits
+func (b *apkBundle) info() apkInfo {
+	var base *apkSource
+	abis := map[string]bool{}
+	for _, src := range b.sources {
+		if len(src.info.Split) == 0 && base == nil {
+			base = src
+		}
+		for _, abi := range src.info.ABIs {
+			abis[abi] = true
+		}
+	}
+	if base == nil {
+		panic(withCode("split_mismatch", fmt.Errorf("no base apk among %d splits", len(b.sources))))
+	}
+	info := base.info
+	info.ABIs = nil
+	for abi := range abis {
+		info.ABIs = append(info.ABIs, abi)
+	}
+	sort.Strings(info.ABIs)
+	for _, src := range b.sources {
+		if src.info.Package != info.Package || src.info.VersionCode != info.VersionCode {
+			panic(withCode("split_mismatch", fmt.Errorf("%s belongs to %s (%d), not %s (%d)", src.name,
+				src.info.Package, src.info.VersionCode, info.Package, info.VersionCode)))
+		}
+	}
+	return info
+}
+
+// entries validates every file of every apk, applies the rules and merges the result, refusing
+// targets that two splits provide with different content
+func (b *apkBundle) entries(base string, rules *unpackRules) (result []apkEntry, skip int) {
+	merged := map[string]apkEntry{}
+	var conflicts []string
+	for _, src := range b.sources {
+		for _, f := range src.reader.File {
+			if err := checkZipEntry(f); err != nil {
+				panic(withCode("unsafe_entry", fmt.Errorf("%s: %v", src.name, err)))
+			}
+			if _, err := archiveTarget(base, f.Name); err != nil {
+				panic(withCode("unsafe_entry", fmt.Errorf("%s: %v", src.name, err)))
+			}
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			target, ok := rules.filter(f.Name)
+			if !ok {
+				skip++
+				continue
+			}
+			if prev, exists := merged[target]; exists {
+				if prev.file.CRC32 != f.CRC32 || prev.file.UncompressedSize64 != f.UncompressedSize64 {
+					conflicts = append(conflicts, fmt.Sprintf("%s (%s, %s)", target, prev.source.name, src.name))
+				}
+				continue
+			}
+			merged[target] = apkEntry{source: src, file: f, target: target}
+		}
+	}
+	if len(conflicts) > 0 {
+		panic(withCode("split_conflict", fmt.Errorf("conflicting entries between splits:\n\t%s", strings.Join(conflicts, "\n\t"))))
+	}
+	for _, entry := range merged {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].target < result[j].target })
+	return
+}
+
+// sourceNames lists the apks of the bundle for the unpack manifest
+func (b *apkBundle) sourceNames() string {
+	var names []string
+	for _, src := range b.sources {
+		names = append(names, path.Base(src.name))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// profileConfig is <profile>.toml, the settings of mcpeserver itself; <profile>.cfg belongs to the server core
+type profileConfig struct {
+	Schedule []scheduleEntry `toml:"schedule"`
+	Launch   launchConfig    `toml:"launch"`
+	Limits   limitsConfig    `toml:"limits"`
+	Sandbox  sandboxConfig   `toml:"sandbox"`
+}
+
+// duration reads "90s", "5m" or "1h30m" from the config
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func profileConfigPath(profile string) string {
+	return profile + ".toml"
+}
+
+// loadProfileConfig reads and checks <profile>.toml, a missing file is an empty config
+func loadProfileConfig(profile string) *profileConfig {
+	config := &profileConfig{}
+	file := profileConfigPath(profile)
+	if _, err := os.Stat(file); err == nil {
+		meta, err := toml.DecodeFile(file, config)
+		if err != nil {
+			panic(fmt.Errorf("%s: %v", file, err))
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			printWarn(fmt.Sprintf("%s: ignoring unknown keys %v", file, undecoded))
+		}
+	}
+	if err := config.Launch.check(); err != nil {
+		panic(fmt.Errorf("%s: launch: %v", file, err))
+	}
+	if err := config.Limits.check(); err != nil {
+		panic(fmt.Errorf("%s: limits: %v", file, err))
+	}
+	if err := config.Sandbox.check(); err != nil {
+		panic(fmt.Errorf("%s: sandbox: %v", file, err))
+	}
+	seen := map[string]bool{}
+	for i := range config.Schedule {
+		entry := &config.Schedule[i]
+		if err := entry.check(); err != nil {
+			panic(fmt.Errorf("%s: schedule %q: %v", file, entry.Name, err))
+		}
+		if seen[entry.Name] {
+			panic(fmt.Errorf("%s: schedule %q is defined twice", file, entry.Name))
+		}
+		seen[entry.Name] = true
+	}
+	return config
+}
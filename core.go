@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Every installed version lives in versionsDir/<version>/{bin,data}, and the ./bin and ./data
+// symlinks point to the version in use.
+const versionsDir = "versions"
+
+var coreKinds = map[string]string{
+	"core": "bin",
+	"data": "data",
+}
+
+func checkVersionName(version string) {
+	if len(version) == 0 || strings.ContainsAny(version, "/\\") || strings.HasPrefix(version, ".") {
+		panic(fmt.Errorf("invalid version name: %q", version))
+	}
+}
+
+func versionPath(version, kind string) string {
+	return filepath.Join(versionsDir, version, coreKinds[kind])
+}
+
+// switchLink atomically repoints the symlink name to target by renaming a fresh symlink over it,
+// moving a real directory found at name into the versions directory first
+func switchLink(name, target string) error {
+	if info, err := os.Lstat(name); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		adopted := filepath.Join(versionsDir, "adopted-"+time.Now().Format("20060102150405"), name)
+		printWarn(fmt.Sprintf("./%s is not a symlink, moving it to %s", name, adopted))
+		if err = os.MkdirAll(filepath.Dir(adopted), 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(name, adopted); err != nil {
+			return err
+		}
+	}
+	tmp := name + ".new"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// currentVersion returns the version the symlink of kind points to, or "" if it is not a managed version
+func currentVersion(kind string) string {
+	target, err := os.Readlink(coreKinds[kind])
+	if err != nil {
+		return ""
+	}
+	target = filepath.Clean(target)
+	if filepath.Base(target) != coreKinds[kind] || filepath.Dir(filepath.Dir(target)) != versionsDir {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(target))
+}
+
+func listVersions() []string {
+	infos, err := ioutil.ReadDir(versionsDir)
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	var result []string
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			result = append(result, info.Name())
+		}
+	}
+	return result
+}
+
+func coreList() {
+	current := map[string]string{}
+	for kind := range coreKinds {
+		current[kind] = currentVersion(kind)
+	}
+	for _, version := range listVersions() {
+		var kinds []string
+		for _, kind := range []string{"core", "data"} {
+			if _, err := os.Stat(versionPath(version, kind)); err != nil {
+				continue
+			}
+			if current[kind] == version {
+				kind += "*"
+			}
+			kinds = append(kinds, kind)
+		}
+		printPair(version, strings.Join(kinds, ", "))
+	}
+	for _, kind := range []string{"core", "data"} {
+		if current[kind] == "" {
+			if target, err := os.Readlink(coreKinds[kind]); err == nil {
+				printWarn(fmt.Sprintf("./%s points to unmanaged %s", coreKinds[kind], target))
+			}
+		}
+	}
+}
+
+// coreInstall copies a directory, extracts an archive, or (for data) unpacks an apk into versions/<version>
+func coreInstall(kind, version, source string) {
+	if _, ok := coreKinds[kind]; !ok {
+		panic(fmt.Errorf("unknown kind: %s", kind))
+	}
+	if len(version) == 0 {
+		version = filepath.Base(source)
+		for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip", ".apks", ".xapk", ".apk"} {
+			version = strings.TrimSuffix(version, ext)
+		}
+	}
+	checkVersionName(version)
+	target := versionPath(version, kind)
+	if _, err := os.Stat(target); err == nil {
+		panic(fmt.Errorf("%s %s is already installed", kind, version))
+	}
+	tmp := filepath.Join(versionsDir, "."+version+"."+kind+".tmp")
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	info, err := os.Stat(source)
+	if err != nil {
+		panic(err)
+	}
+	switch {
+	case info.IsDir():
+		err = copyTree(source, tmp)
+	case kind == "data" && (strings.HasSuffix(source, ".apk") || strings.HasSuffix(source, ".apks") || strings.HasSuffix(source, ".xapk")):
+		unpack(tmp, []string{source}, unpackOptions{rules: loadRules(""), jobs: runtime.NumCPU()})
+	case strings.HasSuffix(source, ".zip"):
+		err = extractZip(source, tmp)
+	case strings.HasSuffix(source, ".tar.gz"), strings.HasSuffix(source, ".tgz"), strings.HasSuffix(source, ".tar"):
+		err = extractTar(source, tmp)
+	default:
+		err = fmt.Errorf("unsupported source: %s", source)
+	}
+	if err != nil {
+		panic(err)
+	}
+	root := tmp
+	// archives usually wrap everything in a single top-level directory
+	if infos, err := ioutil.ReadDir(tmp); err == nil && len(infos) == 1 && infos[0].IsDir() && !info.IsDir() {
+		root = filepath.Join(tmp, infos[0].Name())
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		panic(err)
+	}
+	if err = os.Rename(root, target); err != nil {
+		panic(err)
+	}
+	// keep the unpack manifest with the data it describes
+	os.Rename(manifestPath(tmp), manifestPath(target))
+	printPair("Installed", fmt.Sprintf("%s %s", kind, version))
+}
+
+// coreUse switches the requested kinds (all installed kinds of the version if empty) to version
+func coreUse(kind, version string) {
+	checkVersionName(version)
+	kinds := []string{"core", "data"}
+	if len(kind) > 0 {
+		if _, ok := coreKinds[kind]; !ok {
+			panic(fmt.Errorf("unknown kind: %s", kind))
+		}
+		kinds = []string{kind}
+	}
+	switched := 0
+	for _, k := range kinds {
+		if _, err := os.Stat(versionPath(version, k)); err != nil {
+			if len(kind) > 0 {
+				panic(fmt.Errorf("%s %s is not installed", k, version))
+			}
+			continue
+		}
+		if err := switchLink(coreKinds[k], versionPath(version, k)); err != nil {
+			panic(err)
+		}
+		printPair("Using", fmt.Sprintf("%s %s", k, version))
+		switched++
+	}
+	if switched == 0 {
+		panic(fmt.Errorf("version %s is not installed", version))
+	}
+}
+
+func coreRemove(version string, force bool) {
+	checkVersionName(version)
+	if _, err := os.Stat(filepath.Join(versionsDir, version)); err != nil {
+		panic(fmt.Errorf("version %s is not installed", version))
+	}
+	for kind := range coreKinds {
+		if currentVersion(kind) == version && !force {
+			panic(fmt.Errorf("%s %s is in use (use -force to remove anyway)", kind, version))
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(versionsDir, version)); err != nil {
+		panic(err)
+	}
+	printPair("Removed", version)
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(dst, in, mode)
+}
+
+func writeFile(dst string, in io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func extractZip(file, base string) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if err = checkZipEntry(f); err != nil {
+			return err
+		}
+		target, err := archiveTarget(base, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeFile(target, rc, entryMode(f))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(file, base string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var reader io.Reader = in
+	if !strings.HasSuffix(file, ".tar") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		target, err := archiveTarget(base, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// the links checked below are the only ones on disk, but one may already have been replaced
+		if err = checkInside(base, target); err != nil {
+			return unsafeEntryError{hdr.Name, err.Error()}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeFile(target, tr, os.FileMode(hdr.Mode).Perm())
+		case tar.TypeSymlink:
+			if err = checkTarLink(base, target, hdr); err != nil {
+				return err
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		default:
+			printWarn(fmt.Sprintf("Skipping unsupported tar entry: %s", hdr.Name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkTarLink only lets a symlink point at something inside base, relative to its own directory
+func checkTarLink(base, target string, hdr *tar.Header) error {
+	link := hdr.Linkname
+	if len(link) == 0 || filepath.IsAbs(link) || strings.ContainsRune(link, 0) {
+		return unsafeEntryError{hdr.Name, fmt.Sprintf("symlink to %q", link)}
+	}
+	resolved := filepath.Join(filepath.Dir(target), filepath.FromSlash(link))
+	if rel, err := filepath.Rel(base, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return unsafeEntryError{hdr.Name, fmt.Sprintf("symlink to %q escapes target", link)}
+	}
+	if err := checkInside(base, resolved); err != nil {
+		return unsafeEntryError{hdr.Name, err.Error()}
+	}
+	return nil
+}
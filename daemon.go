@@ -1,16 +1,334 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/google/subcommands"
+)
+
+// restartPolicy decides when the supervisor starts the server again
+type restartPolicy struct {
+	mode        string // always, on-failure or never
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	crashLimit  int
+	crashWindow time.Duration
+	alert       string
+}
+
+// procExit is how one run of the server ended, kept as a line of <profile>.history
+type procExit struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Code     int       `json:"code"`
+	Signal   int       `json:"signal,omitempty"`
+	CoreDump bool      `json:"core_dump,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Restart  string    `json:"restart,omitempty"`
+	// cgroup accounting, when the server ran in a group of its own
+	OOMKilled  bool          `json:"oom_killed,omitempty"`
+	CPU        time.Duration `json:"cpu,omitempty"`
+	MemoryPeak int64         `json:"memory_peak,omitempty"`
+}
+
+func (e procExit) failed() bool {
+	return e.Code != 0 || e.Signal != 0 || len(e.Error) > 0
+}
+
+func (e procExit) String() string {
+	switch {
+	case len(e.Error) > 0:
+		return "failed to start: " + e.Error
+	case e.OOMKilled:
+		return "killed by the OOM killer at the memory limit"
+	case e.CoreDump:
+		return fmt.Sprintf("killed by signal %d (%v), core dumped", e.Signal, syscall.Signal(e.Signal))
+	case e.Signal == int(syscall.SIGKILL):
+		return "killed by SIGKILL (the OOM killer or a forced stop)"
+	case e.Signal != 0:
+		return fmt.Sprintf("killed by signal %d (%v)", e.Signal, syscall.Signal(e.Signal))
+	}
+	return fmt.Sprintf("exited with code %d", e.Code)
+}
+
+func (e procExit) runtime() time.Duration {
+	return e.End.Sub(e.Start).Round(time.Second)
+}
+
+// Process exit codes of run and daemon, telling scripts and systemd (RestartPreventExitStatus=...)
+// how the server ended; 1 and 2 stay the generic failure and usage error of subcommands
+const (
+	exitServerError = 3 // the server exited with a non-zero code
+	exitSignaled    = 4 // the server was killed by a signal
+	exitKilled      = 5 // the server was killed by SIGKILL, usually the OOM killer
+	exitCoreDump    = 6 // the server crashed and dumped core
+	exitStartFailed = 7 // the server could not be started
+	exitOOMKilled   = 8 // the server hit the memory limit of its cgroup
 )
 
-func runDaemon(profile string, systemd bool) {
-	cmd := exec.Command("./bin/bedrockserver", profile)
-	cmd.Dir, _ = os.Getwd()
-	cmd.Env = append(cmd.Env, "LD_LIBRARY_PATH=./lib", "XDG_CACHE_HOME=./cache")
-	cmd.Start()
-	if systemd {
-		cmd.Wait()
+func (e procExit) exitStatus() subcommands.ExitStatus {
+	switch {
+	case len(e.Error) > 0:
+		return exitStartFailed
+	case e.OOMKilled:
+		return exitOOMKilled
+	case e.CoreDump:
+		return exitCoreDump
+	case e.Signal == int(syscall.SIGKILL):
+		return exitKilled
+	case e.Signal != 0:
+		return exitSignaled
+	case e.Code != 0:
+		return exitServerError
+	}
+	return subcommands.ExitSuccess
+}
+
+func (e procExit) print() {
+	if e.failed() {
+		printWarn("Server " + e.String())
+	} else {
+		printPair("Exit", e.String())
+	}
+	printPair("Runtime", e.runtime().String())
+	if e.CPU > 0 {
+		printPair("CPU time", e.CPU.Round(time.Millisecond).String())
+	}
+	if e.MemoryPeak > 0 {
+		printPair("Peak memory", formatSize(uint64(e.MemoryPeak)))
+	}
+}
+
+func newProcExit(start time.Time, state *os.ProcessState, err error) procExit {
+	result := procExit{Start: start, End: time.Now(), Code: -1}
+	if state == nil {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		result.Signal = int(ws.Signal())
+		result.CoreDump = ws.CoreDump()
+		return result
+	}
+	result.Code = state.ExitCode()
+	return result
+}
+
+// recordExit appends the exit to <profile>.history and notes it in <profile>.log
+func recordExit(profile string, e procExit) {
+	if f, err := os.OpenFile(profile+".history", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err == nil {
+		json.NewEncoder(f).Encode(e)
+		f.Close()
+	}
+	logEvent(profile, "server %s after %v%s", e, e.runtime(), restartNote(e))
+}
+
+// logEvent writes a line of mcpeserver's own to the profile log, next to the server output
+func logEvent(profile, format string, args ...interface{}) {
+	if f, err := os.OpenFile(profile+".log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err == nil {
+		fmt.Fprintf(f, "mcpeserver: "+format+"\n", args...)
+		f.Close()
+	}
+}
+
+func restartNote(e procExit) string {
+	if len(e.Restart) == 0 {
+		return ""
+	}
+	return ", " + e.Restart
+}
+
+// raiseAlert runs the alert command with details of the crash loop in its environment
+func raiseAlert(command, profile string, last procExit, crashes int) {
+	if len(command) == 0 {
+		return
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"MCPE_PROFILE="+profile,
+		fmt.Sprintf("MCPE_EXIT_CODE=%d", last.Code),
+		fmt.Sprintf("MCPE_SIGNAL=%d", last.Signal),
+		fmt.Sprintf("MCPE_CRASHES=%d", crashes),
+		"MCPE_REASON="+last.String())
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		printWarn(fmt.Sprintf("Alert command failed: %v", err))
+	}
+}
+
+// runDaemon supervises the server, restarting it according to policy until it exits for good,
+// the crash-loop limit is hit or a signal arrives on signals, and returns the last exit
+func runDaemon(profile string, config *profileConfig, policy restartPolicy, wd watchdogOptions, n *notifier, signals <-chan os.Signal) procExit {
+	var health watchdogState
+	var wdBus, statusBus bus
+	if every := wd.systemdWatchdog(); every > 0 {
+		quit := make(chan struct{})
+		defer close(quit)
+		go keepAlive(every, &health, quit)
+	}
+
+	os.Remove(stopMarker(profile))
+	os.Remove(restartMarker(profile))
+	var crashes []time.Time
+	delay := policy.backoff
+	for {
+		cmd, cg, err := serverCommand(profile, config)
+		start := time.Now()
+		var state *os.ProcessState
+		if err == nil {
+			err = cmd.Start()
+		}
+		stopping := false
+		if err == nil {
+			waited := make(chan error, 1)
+			exited := make(chan struct{})
+			go func() {
+				err := cmd.Wait()
+				close(exited)
+				waited <- err
+			}()
+			if wd.interval > 0 {
+				go watchdog(profile, &wdBus, cmd.Process, wd, &health, exited)
+			}
+			if n.enabled {
+				// without restarts of our own systemd may as well watch the server itself
+				if policy.mode == "never" {
+					n.send(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+				}
+				go n.reportStatus(profile, &statusBus, start, exited)
+			}
+			for done := false; !done; {
+				select {
+				case sig := <-signals:
+					// pass the signal on and stop supervising once the server is gone
+					if !stopping {
+						n.send(daemon.SdNotifyStopping)
+						n.status("Stopping server")
+					}
+					stopping = true
+					cmd.Process.Signal(sig)
+				case err = <-waited:
+					done = true
+				}
+			}
+			state = cmd.ProcessState
+		}
+		exit := newProcExit(start, state, err)
+		if config.Sandbox.Enabled {
+			exit.fromSandboxInit()
+		}
+		cg.account(&exit)
+		if stopping {
+			exit.Restart = "supervisor stopped"
+			recordExit(profile, exit)
+			return exit
+		}
+		if os.Remove(stopMarker(profile)) == nil {
+			n.send(daemon.SdNotifyStopping)
+			exit.Restart = "stopped on request"
+			recordExit(profile, exit)
+			return exit
+		}
+		if os.Remove(restartMarker(profile)) == nil {
+			exit.Restart = "restarting on request"
+			recordExit(profile, exit)
+			continue
+		}
+
+		hung := atomic.LoadInt32(&health.hung) != 0
+		atomic.StoreInt32(&health.misses, 0)
+		// a hung server is restarted whatever the policy, it did not choose to exit
+		restart := hung || policy.mode == "always" || policy.mode == "on-failure" && exit.failed()
+		if !restart {
+			recordExit(profile, exit)
+			return exit
+		}
+		if exit.failed() {
+			// a run that stayed up for longer than the largest backoff was not part of a crash loop
+			if exit.End.Sub(exit.Start) >= policy.maxBackoff {
+				delay = policy.backoff
+			}
+			crashes = append(crashes, exit.End)
+			for len(crashes) > 0 && exit.End.Sub(crashes[0]) > policy.crashWindow {
+				crashes = crashes[1:]
+			}
+			if policy.crashLimit > 0 && len(crashes) >= policy.crashLimit {
+				exit.Restart = fmt.Sprintf("crash loop (%d crashes in %v), giving up", len(crashes), policy.crashWindow)
+				recordExit(profile, exit)
+				printWarn(fmt.Sprintf("Server %s, %s", exit, exit.Restart))
+				raiseAlert(policy.alert, profile, exit, len(crashes))
+				panic(fmt.Errorf("server is crash looping: %s", exit))
+			}
+		} else {
+			delay = policy.backoff
+		}
+		exit.Restart = fmt.Sprintf("restarting in %v", delay)
+		if hung {
+			exit.Restart = "hung, " + exit.Restart
+		}
+		recordExit(profile, exit)
+		printWarn(fmt.Sprintf("Server %s, %s", exit, exit.Restart))
+		n.status("Server %s, %s", exit, exit.Restart)
+		select {
+		case <-time.After(delay):
+		case <-signals:
+			return exit
+		}
+		if exit.failed() {
+			delay *= 2
+			if delay > policy.maxBackoff {
+				delay = policy.maxBackoff
+			}
+		}
+	}
+}
+
+func readHistory(profile string) ([]procExit, error) {
+	f, err := os.Open(profile + ".history")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exits []procExit
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e procExit
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			exits = append(exits, e)
+		}
+	}
+	return exits, scanner.Err()
+}
+
+// lastExit is the latest exit recorded for the profile
+func lastExit(profile string) (procExit, bool) {
+	exits, _ := readHistory(profile)
+	if len(exits) == 0 {
+		return procExit{}, false
+	}
+	return exits[len(exits)-1], true
+}
+
+// printHistory shows the last n exits recorded for the profile
+func printHistory(profile string, n int) {
+	exits, err := readHistory(profile)
+	if err != nil {
+		panic(err)
+	}
+	if n > 0 && len(exits) > n {
+		exits = exits[len(exits)-n:]
+	}
+	for _, e := range exits {
+		printPair(e.End.Format("2006-01-02 15:04:05"), fmt.Sprintf("%s after %v%s", e, e.runtime(), restartNote(e)))
 	}
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/godbus/dbus"
 )
@@ -11,12 +13,13 @@ type bus struct {
 	conn *dbus.Conn
 	log  chan *dbus.Signal
 	obj  dbus.BusObject
+	name string
+	// private is set for a connection of our own, which unlike the shared one may be closed
+	private bool
 }
 
 func (b *bus) init(profile string) {
-	var err error
-	b.conn, err = dbus.SystemBus()
-	if err != nil {
+	if err := b.dial(profile); err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to connect to session bus:", err)
 		os.Exit(1)
 	}
@@ -24,7 +27,50 @@ func (b *bus) init(profile string) {
 		fmt.Sprintf("type='signal',path='/one/codehz/bedrockserver',interface='one.codehz.bedrockserver.core',sender='one.codehz.bedrockserver.%s'", profile))
 	b.log = make(chan *dbus.Signal, 10)
 	b.conn.Signal(b.log)
-	b.obj = b.conn.Object("one.codehz.bedrockserver."+profile, "/one/codehz/bedrockserver")
+}
+
+// dial connects without subscribing to the log signals, for long-running callers that would never
+// drain them and must not exit when the bus is unavailable
+func (b *bus) dial(profile string) error {
+	var err error
+	b.conn, err = dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+	b.name = "one.codehz.bedrockserver." + profile
+	b.obj = b.conn.Object(b.name, "/one/codehz/bedrockserver")
+	return nil
+}
+
+// redial replaces the connection with a private one, the shared connection stays broken for good
+// once the bus daemon has dropped it
+func (b *bus) redial(profile string) error {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return err
+	}
+	if err = conn.Auth(nil); err == nil {
+		err = conn.Hello()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	b.release()
+	b.conn = conn
+	b.private = true
+	b.name = "one.codehz.bedrockserver." + profile
+	b.obj = b.conn.Object(b.name, "/one/codehz/bedrockserver")
+	return nil
+}
+
+// release closes the connection if it is our own and leaves the shared one to the others using it
+func (b *bus) release() {
+	if b.private {
+		b.conn.Close()
+	}
+	b.conn = nil
+	b.private = false
 }
 
 func (b bus) close() {
@@ -46,3 +92,28 @@ func (b bus) ping() (string, error) {
 func (b bus) stop() error {
 	return b.obj.Call("one.codehz.bedrockserver.core.stop", 0).Err
 }
+
+// pid asks the bus daemon for the process that owns the profile's bus name
+func (b bus) pid() (int, error) {
+	var pid uint32
+	err := b.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, b.name).Store(&pid)
+	return int(pid), err
+}
+
+var errPingTimeout = errors.New("ping timed out")
+
+// pingWithin is ping with a deadline, a hung core never answers at all
+func (b bus) pingWithin(timeout time.Duration) (string, error) {
+	call := b.obj.Go("one.codehz.bedrockserver.core.ping", 0, make(chan *dbus.Call, 1))
+	select {
+	case <-call.Done:
+		var result string
+		if call.Err != nil {
+			return "", call.Err
+		}
+		err := call.Store(&result)
+		return result, err
+	case <-time.After(timeout):
+		return "", errPingTimeout
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// launchConfig is the [launch] table of the profile config, how the server process is started
+type launchConfig struct {
+	Binary string   `toml:"binary"`
+	Args   []string `toml:"args"`
+	Dir    string   `toml:"dir"`
+	// Inherit names the variables passed on from our environment, "LC_*" style prefixes and "*" work too
+	Inherit []string          `toml:"inherit_env"`
+	Env     map[string]string `toml:"env"`
+	Umask   string            `toml:"umask"`
+	Nice    int               `toml:"nice"`
+	IONice  string            `toml:"ionice"`
+
+	umask   int
+	ioClass int
+	ioLevel int
+}
+
+var defaultInherit = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "TZ", "LANG", "LC_*"}
+
+// ionice classes as ioprio_set(2) numbers them
+var ioClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+func (l *launchConfig) check() error {
+	if len(l.Binary) == 0 {
+		l.Binary = "./bin/bedrockserver"
+	}
+	if l.Inherit == nil {
+		l.Inherit = defaultInherit
+	}
+	l.umask = -1
+	if len(l.Umask) > 0 {
+		umask, err := strconv.ParseUint(l.Umask, 8, 32)
+		if err != nil || umask > 0777 {
+			return fmt.Errorf("bad umask %q, use octal like \"027\"", l.Umask)
+		}
+		l.umask = int(umask)
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("nice %d is out of range -20..19", l.Nice)
+	}
+	if len(l.IONice) > 0 {
+		parts := strings.SplitN(l.IONice, ":", 2)
+		class, ok := ioClasses[parts[0]]
+		if !ok {
+			return fmt.Errorf("unknown ionice class %q (realtime, best-effort, idle)", parts[0])
+		}
+		l.ioClass = class
+		l.ioLevel = 4
+		if len(parts) == 2 {
+			level, err := strconv.Atoi(parts[1])
+			if err != nil || level < 0 || level > 7 {
+				return fmt.Errorf("ionice level %q is out of range 0..7", parts[1])
+			}
+			l.ioLevel = level
+		}
+	}
+	for key := range l.Env {
+		if len(key) == 0 || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("bad environment variable name %q", key)
+		}
+	}
+	return nil
+}
+
+func inherited(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == name || pattern == "*" || strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// environ builds the server environment: the inherited variables, then the core's defaults, then env;
+// $VAR in env refers to the first two only, never to another env entry, so the order does not matter
+func (l *launchConfig) environ() []string {
+	base := map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 && inherited(l.Inherit, kv[:i]) {
+			base[kv[:i]] = kv[i+1:]
+		}
+	}
+	base["LD_LIBRARY_PATH"] = "./lib"
+	base["XDG_CACHE_HOME"] = "./cache"
+	vars := map[string]string{}
+	for key, value := range base {
+		vars[key] = value
+	}
+	for key, value := range l.Env {
+		vars[key] = os.Expand(value, func(name string) string { return base[name] })
+	}
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// spawnHelper is the argument that makes mcpeserver act as the spawn helper instead of a command
+const spawnHelper = "__spawn"
+
+// serverCommand is the one place run and daemon build the server process from the profile config;
+// the cgroup, if any, has to account for the run once it is over
+func serverCommand(profile string, config *profileConfig) (*exec.Cmd, *cgroup, error) {
+	l := config.Launch
+	dir, err := filepath.Abs(l.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	args := append([]string{profile}, l.Args...)
+	cg := serverCgroup(profile, config.Limits)
+	// these have to be set from inside the new process before it runs the server
+	var helper []string
+	if l.umask >= 0 {
+		helper = append(helper, "-umask", strconv.Itoa(l.umask))
+	}
+	if l.Nice != 0 {
+		helper = append(helper, "-nice", strconv.Itoa(l.Nice))
+	}
+	if l.ioClass != 0 {
+		helper = append(helper, "-io-class", strconv.Itoa(l.ioClass), "-io-level", strconv.Itoa(l.ioLevel))
+	}
+	for _, limit := range config.Limits.rlimits(cg) {
+		helper = append(helper, "-rlimit", limit)
+	}
+	if cg != nil {
+		helper = append(helper, "-cgroup", cg.dir)
+	}
+	if config.Sandbox.Enabled {
+		sandbox, err := config.Sandbox.prepare()
+		if err != nil {
+			cg.remove()
+			return nil, nil, fmt.Errorf("sandbox: %v", err)
+		}
+		helper = append(helper, sandbox...)
+	}
+	cmd := exec.Command(l.Binary, args...)
+	if len(helper) > 0 {
+		self, err := os.Executable()
+		if err != nil {
+			cg.remove()
+			return nil, nil, err
+		}
+		log, _ := filepath.Abs(profile + ".log")
+		helper = append(append([]string{spawnHelper, "-log", log}, helper...), "--", l.Binary)
+		cmd = exec.Command(self, append(helper, args...)...)
+	}
+	cmd.Dir = dir
+	cmd.Env = l.environ()
+	if config.Sandbox.Enabled {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: config.Sandbox.cloneflags()}
+	}
+	return cmd, cg, nil
+}
+
+const ioprioWhoProcess = 1
+
+// runSpawnHelper applies the process settings to itself and becomes the server, it never returns
+func runSpawnHelper(args []string) {
+	f := flag.NewFlagSet(spawnHelper, flag.ExitOnError)
+	log := f.String("log", "", "")
+	umask := f.Int("umask", -1, "")
+	nice := f.Int("nice", 0, "")
+	ioClass := f.Int("io-class", 0, "")
+	ioLevel := f.Int("io-level", 4, "")
+	var rlimits stringList
+	f.Var(&rlimits, "rlimit", "")
+	group := f.String("cgroup", "", "")
+	sandbox := f.Bool("sandbox", false, "")
+	uid := f.Int("uid", -1, "")
+	gid := f.Int("gid", -1, "")
+	var readonly, writable, allow stringList
+	f.Var(&readonly, "ro", "")
+	f.Var(&writable, "rw", "")
+	f.Var(&allow, "allow", "")
+	f.Parse(args)
+	err := func() error {
+		if f.NArg() == 0 {
+			return errors.New("no binary to run")
+		}
+		// join the group before anything else, so every process the server starts is in it too
+		if len(*group) > 0 {
+			if err := writeCgroupFile(*group, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+				return fmt.Errorf("cgroup: %v", err)
+			}
+		}
+		for _, limit := range rlimits {
+			if err := setRlimit(limit); err != nil {
+				return err
+			}
+		}
+		if *umask >= 0 {
+			syscall.Umask(*umask)
+		}
+		if *nice != 0 {
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *nice); err != nil {
+				return fmt.Errorf("nice %d: %v", *nice, err)
+			}
+		}
+		if *ioClass != 0 {
+			prio := uintptr(*ioClass<<13 | *ioLevel)
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prio); errno != 0 {
+				return fmt.Errorf("ionice: %v", errno)
+			}
+		}
+		binary := f.Arg(0)
+		if !strings.Contains(binary, "/") {
+			path, err := exec.LookPath(binary)
+			if err != nil {
+				return err
+			}
+			binary = path
+		}
+		// last, the sandbox takes away what the steps above need
+		if *sandbox {
+			if err := enterSandbox(*uid, *gid, readonly, writable, allow); err != nil {
+				return fmt.Errorf("sandbox: %v", err)
+			}
+			return runInit(binary, f.Args())
+		}
+		return syscall.Exec(binary, f.Args(), os.Environ())
+	}()
+	fmt.Fprintf(os.Stderr, "mcpeserver: failed to start %v: %v\n", f.Args(), err)
+	// the daemon does not keep the server's output
+	if file, lerr := os.OpenFile(*log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); lerr == nil {
+		fmt.Fprintf(file, "mcpeserver: failed to start %v: %v\n", f.Args(), err)
+		file.Close()
+	}
+	os.Exit(exitStartFailed)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("MCPE_SECRET", "hidden")
+	l := launchConfig{Inherit: []string{"PATH"}, Env: map[string]string{
+		"PATH":            "./bin:$PATH",
+		"A":               "a",
+		"B":               "[$A]",
+		"C":               "[$B]",
+		"LD_LIBRARY_PATH": "$LD_LIBRARY_PATH:/opt/lib",
+		"LEAK":            "[$MCPE_SECRET]",
+	}}
+	want := map[string]string{
+		"PATH":            "./bin:/usr/bin",
+		"A":               "a",
+		"B":               "[]",
+		"C":               "[]",
+		"LD_LIBRARY_PATH": "./lib:/opt/lib",
+		"XDG_CACHE_HOME":  "./cache",
+		"LEAK":            "[]",
+	}
+	// map order differs between runs, the result must not
+	for i := 0; i < 20; i++ {
+		got := map[string]string{}
+		for _, kv := range l.environ() {
+			parts := strings.SplitN(kv, "=", 2)
+			got[parts[0]] = parts[1]
+		}
+		for key, value := range want {
+			if got[key] != value {
+				t.Fatalf("%s=%q, want %q", key, got[key], value)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
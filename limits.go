@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// byteSize reads "512M", "4G" or "unlimited" from the config
+type byteSize struct {
+	bytes     uint64
+	set       bool
+	unlimited bool
+}
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	b.set = true
+	if s == "unlimited" || s == "max" {
+		b.unlimited = true
+		return nil
+	}
+	shift := uint(0)
+	if len(s) > 0 {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad size %q, use bytes, K, M, G or unlimited", string(text))
+	}
+	if n > ^uint64(0)>>shift {
+		return fmt.Errorf("size %q is too large", string(text))
+	}
+	b.bytes = n << shift
+	return nil
+}
+
+func (b byteSize) MarshalText() ([]byte, error) {
+	if b.unlimited {
+		return []byte("unlimited"), nil
+	}
+	return []byte(strconv.FormatUint(b.bytes, 10)), nil
+}
+
+// limitsConfig is the [limits] table of the profile config
+type limitsConfig struct {
+	Memory byteSize `toml:"memory"`
+	// CPU is the number of cores the server may keep busy, 1.5 for one and a half
+	CPU    float64  `toml:"cpu"`
+	Pids   int      `toml:"pids"`
+	NoFile uint64   `toml:"nofile"`
+	Core   byteSize `toml:"core"`
+	// AddressSpace is RLIMIT_AS, the virtual memory of the server process rather than what it uses
+	AddressSpace byteSize `toml:"address_space"`
+	// Cgroup is auto to use cgroup v2 when it is delegated to us and fall back to rlimits, or off
+	Cgroup string `toml:"cgroup"`
+	// Accounting puts the server into a cgroup for the numbers even without cgroup limits
+	Accounting bool `toml:"accounting"`
+}
+
+func (l *limitsConfig) check() error {
+	switch l.Cgroup {
+	case "":
+		l.Cgroup = "auto"
+	case "auto", "off":
+	default:
+		return fmt.Errorf("unknown cgroup mode %q (auto, off)", l.Cgroup)
+	}
+	if l.CPU < 0 {
+		return errors.New("cpu must not be negative")
+	}
+	if l.Pids < 0 {
+		return errors.New("pids must not be negative")
+	}
+	return nil
+}
+
+// controllers are the cgroup controllers the limits need
+func (l *limitsConfig) controllers() []string {
+	var need []string
+	if l.Memory.set {
+		need = append(need, "memory")
+	}
+	if l.CPU > 0 {
+		need = append(need, "cpu")
+	}
+	if l.Pids > 0 {
+		need = append(need, "pids")
+	}
+	return need
+}
+
+// rlimitNproc is missing from package syscall
+const rlimitNproc = 6
+
+// rlimits are the setrlimit calls for the spawn helper, as resource:value; without a cgroup
+// the pids limit becomes RLIMIT_NPROC, which is coarser, and the memory limit is not applied:
+// RLIMIT_AS counts every reserved mapping and fails the core long before it uses that much
+func (l *limitsConfig) rlimits(cg *cgroup) (limits []string) {
+	add := func(resource int, b byteSize) {
+		value := strconv.FormatUint(b.bytes, 10)
+		if b.unlimited {
+			value = "unlimited"
+		}
+		limits = append(limits, fmt.Sprintf("%d:%s", resource, value))
+	}
+	if l.NoFile > 0 {
+		add(syscall.RLIMIT_NOFILE, byteSize{bytes: l.NoFile})
+	}
+	if l.Core.set {
+		add(syscall.RLIMIT_CORE, l.Core)
+	}
+	if l.AddressSpace.set {
+		add(syscall.RLIMIT_AS, l.AddressSpace)
+	}
+	if cg == nil {
+		if l.Memory.set && !l.Memory.unlimited {
+			printWarn("The memory limit needs a delegated cgroup v2 group and is not applied (address_space sets RLIMIT_AS)")
+		}
+		if l.Pids > 0 {
+			add(rlimitNproc, byteSize{bytes: uint64(l.Pids)})
+		}
+	}
+	return
+}
+
+func setRlimit(spec string) error {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad rlimit %q", spec)
+	}
+	resource, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("bad rlimit %q", spec)
+	}
+	value := ^uint64(0) // RLIM_INFINITY
+	if parts[1] != "unlimited" {
+		if value, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return fmt.Errorf("bad rlimit %q", spec)
+		}
+	}
+	if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+		return fmt.Errorf("rlimit %d to %s: %v", resource, parts[1], err)
+	}
+	return nil
+}
+
+// cgroup is the cgroup v2 group of one run of the server
+type cgroup struct {
+	dir     string
+	profile string
+	oomBase int64
+}
+
+// supervisorGroup is where the launcher moves itself when its group has to hand controllers down
+const supervisorGroup = "supervisor"
+
+// cgroupV2Base finds our own group in the cgroup v2 hierarchy, ignoring the leaf we may have
+// moved ourselves into
+func cgroupV2Base() (string, error) {
+	mounts, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer mounts.Close()
+	mount := ""
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		// 36 25 0:31 / /sys/fs/cgroup rw,... shared:9 - cgroup2 cgroup2 rw
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				mount = fields[4]
+			}
+		}
+	}
+	if len(mount) == 0 {
+		return "", errors.New("cgroup v2 is not mounted")
+	}
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path := strings.TrimSuffix(line[3:], "/"+supervisorGroup)
+			return filepath.Join(mount, path), nil
+		}
+	}
+	return "", errors.New("not in a cgroup v2 group")
+}
+
+func readCgroupValue(dir, name string) (int64, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return value, err == nil
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+}
+
+func readCgroupStat(dir, file, key string) (int64, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == key {
+			value, err := strconv.ParseInt(fields[1], 10, 64)
+			return value, err == nil
+		}
+	}
+	return 0, false
+}
+
+// enableControllers hands the controllers down to the groups below base; a group with processes
+// of its own cannot do that, so the launcher moves itself into a leaf first
+func enableControllers(base string, need []string) error {
+	if len(need) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := map[string]bool{}
+	for _, controller := range strings.Fields(string(data)) {
+		available[controller] = true
+	}
+	var enable []string
+	for _, controller := range need {
+		if !available[controller] {
+			return fmt.Errorf("the %s controller is not delegated to %s", controller, base)
+		}
+		enable = append(enable, "+"+controller)
+	}
+	err = writeCgroupFile(base, "cgroup.subtree_control", strings.Join(enable, " "))
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EBUSY {
+		return err
+	}
+	leaf := filepath.Join(base, supervisorGroup)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return err
+	}
+	return writeCgroupFile(base, "cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+func cgroupPathFile(profile string) string {
+	return profile + ".cgroup"
+}
+
+// setupCgroup creates the group the next run of the server goes into and applies the limits
+func setupCgroup(profile string, l limitsConfig) (*cgroup, error) {
+	base, err := cgroupV2Base()
+	if err != nil {
+		return nil, err
+	}
+	if err = enableControllers(base, l.controllers()); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{dir: filepath.Join(base, "mcpeserver-"+profile), profile: profile}
+	if err = os.Mkdir(cg.dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	limits := map[string]string{}
+	if l.Memory.set {
+		limits["memory.max"] = "max"
+		if !l.Memory.unlimited {
+			limits["memory.max"] = strconv.FormatUint(l.Memory.bytes, 10)
+		}
+	}
+	if l.CPU > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d 100000", int64(l.CPU*100000))
+	}
+	if l.Pids > 0 {
+		limits["pids.max"] = strconv.Itoa(l.Pids)
+	}
+	for name, value := range limits {
+		if err = writeCgroupFile(cg.dir, name, value); err != nil {
+			os.Remove(cg.dir)
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	cg.oomBase, _ = readCgroupStat(cg.dir, "memory.events", "oom_kill")
+	ioutil.WriteFile(cgroupPathFile(profile), []byte(cg.dir+"\n"), 0644)
+	return cg, nil
+}
+
+// account adds what the run used to its exit and removes the group, killing anything the server
+// left behind in it
+func (cg *cgroup) account(e *procExit) {
+	if cg == nil {
+		return
+	}
+	if usec, ok := readCgroupStat(cg.dir, "cpu.stat", "usage_usec"); ok {
+		e.CPU = time.Duration(usec) * time.Microsecond
+	}
+	e.MemoryPeak, _ = readCgroupValue(cg.dir, "memory.peak")
+	if oom, ok := readCgroupStat(cg.dir, "memory.events", "oom_kill"); ok && oom > cg.oomBase && e.Signal == int(syscall.SIGKILL) {
+		e.OOMKilled = true
+	}
+	cg.remove()
+}
+
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	writeCgroupFile(cg.dir, "cgroup.kill", "1")
+	for i := 0; i < 20; i++ {
+		if err := os.Remove(cg.dir); err == nil || os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	os.Remove(cgroupPathFile(cg.profile))
+}
+
+// cgroupUsage describes what the running server of the profile uses right now
+func cgroupUsage(profile string) (string, bool) {
+	data, err := ioutil.ReadFile(cgroupPathFile(profile))
+	if err != nil {
+		return "", false
+	}
+	dir := strings.TrimSpace(string(data))
+	var parts []string
+	if current, ok := readCgroupValue(dir, "memory.current"); ok {
+		parts = append(parts, "memory "+formatSize(uint64(current)))
+	}
+	if usec, ok := readCgroupStat(dir, "cpu.stat", "usage_usec"); ok {
+		parts = append(parts, fmt.Sprintf("cpu time %v", (time.Duration(usec)*time.Microsecond).Round(time.Second)))
+	}
+	if tasks, ok := readCgroupValue(dir, "pids.current"); ok {
+		parts = append(parts, fmt.Sprintf("%d tasks", tasks))
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, ", "), true
+}
+
+// serverCgroup sets up the cgroup of the next run when the limits ask for one, nil means rlimits only
+func serverCgroup(profile string, l limitsConfig) *cgroup {
+	need := l.controllers()
+	if l.Cgroup == "off" || len(need) == 0 && !l.Accounting {
+		return nil
+	}
+	cg, err := setupCgroup(profile, l)
+	if err != nil {
+		if len(need) > 0 {
+			printWarn(fmt.Sprintf("No cgroup for the server (%v), falling back to rlimits", err))
+			if l.CPU > 0 {
+				printWarn("The cpu limit needs a cgroup, running without it")
+			}
+		}
+		return nil
+	}
+	return cg
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		text      string
+		bytes     uint64
+		unlimited bool
+		valid     bool
+	}{
+		{"4096", 4096, false, true},
+		{"512K", 512 << 10, false, true},
+		{"512m", 512 << 20, false, true},
+		{"4G", 4 << 30, false, true},
+		{"2T", 2 << 40, false, true},
+		{"unlimited", 0, true, true},
+		{"max", 0, true, true},
+		{"16777215T", 16777215 << 40, false, true},
+		{"16777216T", 0, false, false},
+		{"18446744073709551615K", 0, false, false},
+		{"-1G", 0, false, false},
+		{"4GB", 0, false, false},
+		{"", 0, false, false},
+	}
+	for _, test := range tests {
+		var b byteSize
+		err := b.UnmarshalText([]byte(test.text))
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error %v, want valid=%v", test.text, err, test.valid)
+			continue
+		}
+		if test.valid && (b.bytes != test.bytes || b.unlimited != test.unlimited) {
+			t.Errorf("%q: got %d (unlimited %v), want %d (unlimited %v)", test.text, b.bytes, b.unlimited, test.bytes, test.unlimited)
+		}
+	}
+}
@@ -5,15 +5,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/valyala/fasttemplate"
 )
 
 type unpackCmd struct {
-	data string
-	apk  string
+	data    string
+	apks    stringList
+	rules   string
+	explain string
+	jobs    int
+	dryRun  bool
+	output  string
 }
 
 func (*unpackCmd) Name() string {
@@ -25,22 +34,59 @@ func (*unpackCmd) Synopsis() string {
 }
 
 func (*unpackCmd) Usage() string {
-	return "unpack [-target] [-apk]\n\tUnpack Minecraft Apk\n"
+	return "unpack [-target] [-apk]... [-rules] [-explain] [-jobs] [-dry-run] [-output]\n\tUnpack Minecraft Apk (repeat -apk for split apks, or pass an .apks/.xapk bundle)\n"
 }
 
 func (c *unpackCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&c.data, "target", "data", "Unpack Target")
-	f.StringVar(&c.apk, "apk", "minecraft.apk", "Unpack Source")
+	f.Var(&c.apks, "apk", "Unpack Source (default minecraft.apk)")
+	f.StringVar(&c.rules, "rules", "", "Include/Exclude/Rename Rule File (built-in rules if empty)")
+	f.StringVar(&c.explain, "explain", "", "Show which rule matches the given entry path and exit")
+	f.IntVar(&c.jobs, "jobs", runtime.NumCPU(), "Parallel Extraction Workers")
+	f.BoolVar(&c.dryRun, "dry-run", false, "Only list what would be extracted")
+	f.StringVar(&c.output, "output", "auto", "Output Mode (auto, text, plain, json)")
 }
 
 func (c *unpackCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			reportFailure("unpack", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	setOutput(c.output)
+	rules := loadRules(c.rules)
+	if len(c.explain) > 0 {
+		rules.explain(c.explain)
+		return subcommands.ExitSuccess
+	}
+	if len(c.apks) == 0 {
+		c.apks = stringList{"minecraft.apk"}
+	}
+	unpack(c.data, c.apks, unpackOptions{rules: rules, jobs: c.jobs, dryRun: c.dryRun})
+	return subcommands.ExitSuccess
+}
+
+type apkinfoCmd struct {
+	apk    string
+	output string
+}
+
+func (*apkinfoCmd) Name() string     { return "apkinfo" }
+func (*apkinfoCmd) Synopsis() string { return "show package, version and ABIs of an apk" }
+func (*apkinfoCmd) Usage() string    { return "apkinfo [-apk] [-output]\n" }
+func (c *apkinfoCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.apk, "apk", "minecraft.apk", "Apk File")
+	f.StringVar(&c.output, "output", "text", "Output Format (text, json)")
+}
+func (c *apkinfoCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("\033[5;91mError: ", r)
 			ret = subcommands.ExitFailure
 		}
 	}()
-	unpack(c.data, c.apk)
+	apkinfo(c.apk, c.output)
 	return subcommands.ExitSuccess
 }
 
@@ -71,6 +117,7 @@ func (a *attachCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 type runCmd struct {
 	profile string
 	prompt  string
+	stop    stopOptions
 }
 
 func (*runCmd) Name() string {
@@ -82,22 +129,23 @@ func (*runCmd) Synopsis() string {
 }
 
 func (*runCmd) Usage() string {
-	return "run [-profile] [-prompt] \n\tRun Minecraft Server\n"
+	return "run [-profile] [-prompt] [-delay] [-timeout] [-kill-timeout] \n\tRun Minecraft Server\n\tExits with 3 if the server failed, 4 if it was killed by a signal, 5 by SIGKILL, 6 if it dumped core and 7 if it could not start\n"
 }
 
 func (c *runCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&c.profile, "profile", "default", "Game Proile")
 	f.StringVar(&c.prompt, "prompt", "{{esc}}[0;36;1mmcpe:{{esc}}[22m//{{username}}@{{hostname}}$ {{esc}}[33;4m", "Prompt String Template")
+	c.stop.setFlags(f, 0)
 }
 
 func checkBin() {
 	if _, err := os.Stat("./bin"); err != nil {
 		printWarn("/bin not found, checking /opt/mcpeserver-core...")
 		if _, err = os.Stat("/opt/mcpeserver-core"); err != nil {
-			printWarn("/opt/mcpeserver-core not found, exiting...")
+			printWarn("/opt/mcpeserver-core not found, install a core with `mcpeserver core install`, exiting...")
 			os.Exit(1)
-		} else {
-			os.Symlink("/opt/mcpeserver-core", "bin")
+		} else if err = switchLink("bin", "/opt/mcpeserver-core"); err != nil {
+			panic(err)
 		}
 	}
 }
@@ -110,27 +158,44 @@ func (c *runCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (
 		}
 	}()
 	checkBin()
-	if run(c.profile, fasttemplate.New(c.prompt, "{{", "}}")) {
-		printInfo("Done.")
-		return subcommands.ExitSuccess
+	lock, err := lockProfile(c.profile, "")
+	if err != nil {
+		panic(err)
 	}
-	printInfo("Failed.")
-	return subcommands.ExitFailure
+	defer unlockProfile(lock)
+	exit := run(c.profile, loadProfileConfig(c.profile), fasttemplate.New(c.prompt, "{{", "}}"), c.stop)
+	exit.print()
+	return exit.exitStatus()
 }
 
 type daemonCmd struct {
-	profile string
-	systemd bool
+	profile  string
+	systemd  bool
+	detach   bool
+	restart  string
+	policy   restartPolicy
+	watchdog watchdogOptions
 }
 
 func (*daemonCmd) Name() string     { return "daemon" }
 func (*daemonCmd) Synopsis() string { return "Daemon" }
 func (*daemonCmd) Usage() string {
-	return "daemon [-profile] [-systemd]\n\tRun server as daemon"
+	return "daemon [-profile] [-systemd] [-detach] [-restart] [-backoff] [-max-backoff] [-crash-limit] [-crash-window] [-alert] [-watchdog-interval] [-watchdog-timeout] [-watchdog-misses] [-watchdog-grace]\n\tRun server as daemon, restarting it when it exits or hangs"
 }
 func (d *daemonCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&d.profile, "profile", "default", "Game Profile")
 	f.BoolVar(&d.systemd, "systemd", false, "Systemd mode")
+	f.BoolVar(&d.detach, "detach", false, "Run In The Background, Logging To <profile>.log")
+	f.StringVar(&d.restart, "restart", "", "Restart Policy (always, on-failure, never; default never with -systemd, on-failure otherwise)")
+	f.DurationVar(&d.policy.backoff, "backoff", time.Second, "Delay Before The First Restart")
+	f.DurationVar(&d.policy.maxBackoff, "max-backoff", time.Minute, "Largest Restart Delay")
+	f.IntVar(&d.policy.crashLimit, "crash-limit", 5, "Crashes Within -crash-window That Stop Restarting (0 to never give up)")
+	f.DurationVar(&d.policy.crashWindow, "crash-window", 10*time.Minute, "Crash Loop Window")
+	f.StringVar(&d.policy.alert, "alert", "", "Shell Command Run When A Crash Loop Is Detected")
+	f.DurationVar(&d.watchdog.interval, "watchdog-interval", 0, "Ping The Server This Often To Detect Hangs (0 for off, or derived from WatchdogSec=)")
+	f.DurationVar(&d.watchdog.timeout, "watchdog-timeout", 5*time.Second, "Ping Deadline")
+	f.IntVar(&d.watchdog.misses, "watchdog-misses", 3, "Missed Pings In A Row Before The Server Is Considered Hung")
+	f.DurationVar(&d.watchdog.grace, "watchdog-grace", 2*time.Minute, "Time Allowed For The Server To Answer Its First Ping")
 }
 func (d *daemonCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
 	defer func() {
@@ -139,8 +204,321 @@ func (d *daemonCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}
 			ret = subcommands.ExitFailure
 		}
 	}()
+	d.policy.mode = d.restart
+	if len(d.policy.mode) == 0 {
+		// systemd restarts the service itself
+		d.policy.mode = "on-failure"
+		if d.systemd {
+			d.policy.mode = "never"
+		}
+	}
+	switch d.policy.mode {
+	case "always", "on-failure", "never":
+	default:
+		panic(fmt.Errorf("unknown restart policy: %s", d.policy.mode))
+	}
+	if d.watchdog.misses < 1 {
+		panic(fmt.Errorf("-watchdog-misses must be at least 1"))
+	}
+	if d.detach && d.systemd {
+		panic(fmt.Errorf("-detach cannot be used with -systemd"))
+	}
+	checkBin()
+	config := loadProfileConfig(d.profile)
+	lock := adoptProfileLock()
+	if lock == nil {
+		var err error
+		if lock, err = lockProfile(d.profile, ""); err != nil {
+			panic(err)
+		}
+		if d.detach {
+			detach(d.profile, lock)
+			return subcommands.ExitSuccess
+		}
+	}
+	defer unlockProfile(lock)
+	sched := startScheduler(d.profile, config)
+	defer sched.stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	exit := runDaemon(d.profile, config, d.policy, d.watchdog, newNotifier(d.systemd), signals)
+	exit.print()
+	return exit.exitStatus()
+}
+
+type stopCmd struct {
+	profile string
+	opts    stopOptions
+}
+
+func (*stopCmd) Name() string     { return "stop" }
+func (*stopCmd) Synopsis() string { return "Stop the server after a countdown" }
+func (*stopCmd) Usage() string {
+	return "stop [-profile] [-delay] [-message] [-announce] [-timeout] [-kill-timeout]\n\tAnnounce the shutdown, ask the server to stop, then send SIGTERM and SIGKILL if it hangs\n"
+}
+func (s *stopCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&s.profile, "profile", "default", "Game Profile")
+	s.opts.setFlags(f, time.Minute)
+}
+func (s *stopCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	stopServer(s.profile, s.opts)
+	return subcommands.ExitSuccess
+}
+
+type scheduleCmd struct{}
+
+func (*scheduleCmd) Name() string     { return "schedule" }
+func (*scheduleCmd) Synopsis() string { return "Show and run the scheduled tasks of a profile" }
+func (*scheduleCmd) Usage() string {
+	return "schedule <list|next|run-now> [args]\n\tThe daemon runs the [[schedule]] entries of <profile>.toml\n"
+}
+func (*scheduleCmd) SetFlags(f *flag.FlagSet) {}
+func (*scheduleCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	cdr := subcommands.NewCommander(f, "schedule")
+	cdr.Register(&scheduleListCmd{}, "")
+	cdr.Register(&scheduleNextCmd{}, "")
+	cdr.Register(&scheduleRunNowCmd{}, "")
+	return cdr.Execute(ctx)
+}
+
+// scheduleProfile holds the flag shared by the schedule subcommands
+type scheduleProfile struct {
+	profile string
+}
+
+func (p *scheduleProfile) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.profile, "profile", "default", "Game Profile")
+}
+
+type scheduleListCmd struct {
+	scheduleProfile
+}
+
+func (*scheduleListCmd) Name() string     { return "list" }
+func (*scheduleListCmd) Synopsis() string { return "List entries with their last and next run" }
+func (*scheduleListCmd) Usage() string    { return "list [-profile]\n" }
+func (c *scheduleListCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	scheduleList(c.profile)
+	return subcommands.ExitSuccess
+}
+
+type scheduleNextCmd struct {
+	scheduleProfile
+}
+
+func (*scheduleNextCmd) Name() string     { return "next" }
+func (*scheduleNextCmd) Synopsis() string { return "Show the entry that runs next" }
+func (*scheduleNextCmd) Usage() string    { return "next [-profile]\n" }
+func (c *scheduleNextCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	scheduleNext(c.profile)
+	return subcommands.ExitSuccess
+}
+
+type scheduleRunNowCmd struct {
+	scheduleProfile
+}
+
+func (*scheduleRunNowCmd) Name() string     { return "run-now" }
+func (*scheduleRunNowCmd) Synopsis() string { return "Run an entry immediately" }
+func (*scheduleRunNowCmd) Usage() string    { return "run-now [-profile] <name>\n" }
+func (c *scheduleRunNowCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	scheduleRunNow(c.profile, f.Arg(0))
+	return subcommands.ExitSuccess
+}
+
+type historyCmd struct {
+	profile string
+	count   int
+}
+
+func (*historyCmd) Name() string     { return "history" }
+func (*historyCmd) Synopsis() string { return "Show how the server exited and was restarted" }
+func (*historyCmd) Usage() string    { return "history [-profile] [-n]\n" }
+func (h *historyCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&h.profile, "profile", "default", "Game Profile")
+	f.IntVar(&h.count, "n", 20, "Number Of Entries (0 for all)")
+}
+func (h *historyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	printHistory(h.profile, h.count)
+	return subcommands.ExitSuccess
+}
+
+type statusCmd struct {
+	profile string
+	config  string
+}
+
+func (*statusCmd) Name() string     { return "status" }
+func (*statusCmd) Synopsis() string { return "Show whether the server is running" }
+func (*statusCmd) Usage() string {
+	return "status [-profile] [-config]\n\tAsk D-Bus for the server and <profile>.pid for the run or daemon holding the profile\n"
+}
+func (s *statusCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&s.profile, "profile", "default", "Game Profile")
+	f.StringVar(&s.config, "config", "", "Show Every Profile Of An up Config Instead")
+}
+func (s *statusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	var running bool
+	if len(s.config) > 0 {
+		running = printUpStatus(s.config)
+	} else {
+		running = printStatus(s.profile)
+	}
+	if !running {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+type killCmd struct {
+	profile string
+	signal  string
+	wait    time.Duration
+}
+
+func (*killCmd) Name() string     { return "kill" }
+func (*killCmd) Synopsis() string { return "Signal the server without a countdown" }
+func (*killCmd) Usage() string {
+	return "kill [-profile] [-signal] [-wait]\n\tSignal the server found over D-Bus, or the run or daemon in <profile>.pid, so that it is not restarted\n"
+}
+func (k *killCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&k.profile, "profile", "default", "Game Profile")
+	f.StringVar(&k.signal, "signal", "TERM", "Signal Name Or Number")
+	f.DurationVar(&k.wait, "wait", 30*time.Second, "Wait This Long For It To Exit (0 to not wait)")
+}
+func (k *killCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	sig, err := parseSignal(k.signal)
+	if err != nil {
+		panic(err)
+	}
+	killProfile(k.profile, sig, k.wait)
+	return subcommands.ExitSuccess
+}
+
+type upCmd struct {
+	config string
+	detach bool
+}
+
+func (*upCmd) Name() string     { return "up" }
+func (*upCmd) Synopsis() string { return "Start and supervise the profiles of a config" }
+func (*upCmd) Usage() string {
+	return "up [-config] [-detach]\n\tStart the [[server]] profiles of the config in order and restart them by their policies\n"
+}
+func (u *upCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&u.config, "config", "servers.toml", "Config Listing The Profiles")
+	f.BoolVar(&u.detach, "detach", false, "Run In The Background, Logging Next To The Config")
+}
+func (u *upCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	if _, err := loadUpConfig(u.config); err != nil {
+		panic(fmt.Errorf("%s: %v", u.config, err))
+	}
 	checkBin()
-	runDaemon(d.profile, d.systemd)
+	name := upLockName(u.config)
+	lock := adoptProfileLock()
+	if lock == nil {
+		var err error
+		if lock, err = lockProfile(name, ""); err != nil {
+			panic(fmt.Errorf("%s is already up, use reload to apply changes: %v", u.config, err))
+		}
+		if u.detach {
+			detach(name, lock)
+			return subcommands.ExitSuccess
+		}
+	}
+	defer unlockProfile(lock)
+	runUp(u.config)
+	return subcommands.ExitSuccess
+}
+
+type downCmd struct {
+	config string
+	wait   time.Duration
+}
+
+func (*downCmd) Name() string     { return "down" }
+func (*downCmd) Synopsis() string { return "Stop every profile started by up" }
+func (*downCmd) Usage() string    { return "down [-config] [-wait]\n" }
+func (d *downCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&d.config, "config", "servers.toml", "Config Listing The Profiles")
+	f.DurationVar(&d.wait, "wait", 2*time.Minute, "Wait This Long For Them To Stop (0 to not wait)")
+}
+func (d *downCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	signalUp(d.config, syscall.SIGTERM, d.wait)
+	return subcommands.ExitSuccess
+}
+
+type reloadCmd struct {
+	config string
+}
+
+func (*reloadCmd) Name() string     { return "reload" }
+func (*reloadCmd) Synopsis() string { return "Apply changes of the up config" }
+func (*reloadCmd) Usage() string {
+	return "reload [-config]\n\tStart added profiles, stop removed ones and restart changed ones, leaving the others alone\n"
+}
+func (r *reloadCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&r.config, "config", "servers.toml", "Config Listing The Profiles")
+}
+func (r *reloadCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	// catch mistakes here rather than in the log of the supervisor
+	if _, err := loadUpConfig(r.config); err != nil {
+		panic(fmt.Errorf("%s: %v", r.config, err))
+	}
+	signalUp(r.config, syscall.SIGHUP, 0)
 	return subcommands.ExitSuccess
 }
 
@@ -155,6 +533,281 @@ func (*versionCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 	return subcommands.ExitSuccess
 }
 
+type updateCmd struct {
+	opts   updateOptions
+	output string
+}
+
+func (*updateCmd) Name() string     { return "update" }
+func (*updateCmd) Synopsis() string { return "Update mcpeserver" }
+func (*updateCmd) Usage() string {
+	return "update [-channel] [-endpoint] [-asset-pattern] [-checksums] [-pubkey] [-insecure] [-retries] [-check] [-rollback] [-output]\n\tDownload the latest release and replace the running binary\n"
+}
+func (u *updateCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&u.opts.channel, "channel", "stable", "Release Channel (stable, beta)")
+	f.StringVar(&u.opts.endpoint, "endpoint", defaultReleaseEndpoint, "Releases API Endpoint")
+	f.StringVar(&u.opts.pattern, "asset-pattern", "mcpeserver*", "Asset Name Pattern ({{os}} and {{arch}} are expanded)")
+	f.StringVar(&u.opts.checksums, "checksums", "SHA256SUMS", "Checksums Asset Name Pattern")
+	f.StringVar(&u.opts.pubkey, "pubkey", "", "Ed25519/minisign Public Key (or key file) to verify the checksums signature")
+	f.BoolVar(&u.opts.insecure, "insecure", false, "Allow releases without checksums")
+	f.IntVar(&u.opts.retries, "retries", 5, "Download Retries")
+	f.BoolVar(&u.opts.check, "check", false, "Only check for update")
+	f.BoolVar(&u.opts.rollback, "rollback", false, "Restore the binary replaced by the last update")
+	f.StringVar(&u.output, "output", "auto", "Output Mode (auto, text, plain, json)")
+}
+func (u *updateCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			reportFailure("update", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	setOutput(u.output)
+	update(u.opts)
+	return subcommands.ExitSuccess
+}
+
+type coreCmd struct{}
+
+func (*coreCmd) Name() string     { return "core" }
+func (*coreCmd) Synopsis() string { return "Manage installed core and data versions" }
+func (*coreCmd) Usage() string {
+	return "core <list|install|use|remove> [args]\n\tKeep several core/data versions under ./" + versionsDir + " and switch between them\n"
+}
+func (*coreCmd) SetFlags(f *flag.FlagSet) {}
+func (*coreCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	cdr := subcommands.NewCommander(f, "core")
+	cdr.Register(&coreListCmd{}, "")
+	cdr.Register(&coreInstallCmd{}, "")
+	cdr.Register(&coreUseCmd{}, "")
+	cdr.Register(&coreRemoveCmd{}, "")
+	return cdr.Execute(ctx)
+}
+
+type coreListCmd struct{}
+
+func (*coreListCmd) Name() string             { return "list" }
+func (*coreListCmd) Synopsis() string         { return "List installed versions (* marks the one in use)" }
+func (*coreListCmd) Usage() string            { return "list\n" }
+func (*coreListCmd) SetFlags(f *flag.FlagSet) {}
+func (*coreListCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	coreList()
+	return subcommands.ExitSuccess
+}
+
+type coreInstallCmd struct {
+	kind    string
+	version string
+}
+
+func (*coreInstallCmd) Name() string     { return "install" }
+func (*coreInstallCmd) Synopsis() string { return "Install a core or data version" }
+func (*coreInstallCmd) Usage() string {
+	return "install [-kind] [-version] <dir|archive>\n\tInstall a directory, .tar.gz/.zip archive or (for data) an apk\n"
+}
+func (c *coreInstallCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.kind, "kind", "core", "Kind (core, data)")
+	f.StringVar(&c.version, "version", "", "Version Name (defaults to the source name)")
+}
+func (c *coreInstallCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	coreInstall(c.kind, c.version, f.Arg(0))
+	return subcommands.ExitSuccess
+}
+
+type coreUseCmd struct {
+	kind string
+}
+
+func (*coreUseCmd) Name() string     { return "use" }
+func (*coreUseCmd) Synopsis() string { return "Switch ./bin and ./data to a version" }
+func (*coreUseCmd) Usage() string    { return "use [-kind] <version>\n" }
+func (c *coreUseCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.kind, "kind", "", "Only switch this kind (core, data)")
+}
+func (c *coreUseCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	coreUse(c.kind, f.Arg(0))
+	return subcommands.ExitSuccess
+}
+
+type coreRemoveCmd struct {
+	force bool
+}
+
+func (*coreRemoveCmd) Name() string     { return "remove" }
+func (*coreRemoveCmd) Synopsis() string { return "Remove an installed version" }
+func (*coreRemoveCmd) Usage() string    { return "remove [-force] <version>\n" }
+func (c *coreRemoveCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.force, "force", false, "Remove even if in use")
+}
+func (c *coreRemoveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	coreRemove(f.Arg(0), c.force)
+	return subcommands.ExitSuccess
+}
+
+type packsCmd struct{}
+
+func (*packsCmd) Name() string     { return "packs" }
+func (*packsCmd) Synopsis() string { return "List built-in and world behavior/resource packs" }
+func (*packsCmd) Usage() string {
+	return "packs <list|show> [args]\n\tScan data/assets and worlds/* for packs and check their uuids and dependencies\n"
+}
+func (*packsCmd) SetFlags(f *flag.FlagSet) {}
+func (*packsCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	cdr := subcommands.NewCommander(f, "packs")
+	cdr.Register(&packsListCmd{}, "")
+	cdr.Register(&packsShowCmd{}, "")
+	return cdr.Execute(ctx)
+}
+
+// packsSource holds the flags shared by the packs subcommands
+type packsSource struct {
+	data   string
+	worlds string
+}
+
+func (s *packsSource) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&s.data, "data", "data", "Unpacked Data Directory")
+	f.StringVar(&s.worlds, "worlds", "worlds", "Worlds Directory")
+}
+
+type packsListCmd struct {
+	packsSource
+}
+
+func (*packsListCmd) Name() string     { return "list" }
+func (*packsListCmd) Synopsis() string { return "Print the pack catalog" }
+func (*packsListCmd) Usage() string    { return "list [-data] [-worlds]\n" }
+func (c *packsListCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	packsList(c.data, c.worlds)
+	return subcommands.ExitSuccess
+}
+
+type packsShowCmd struct {
+	packsSource
+}
+
+func (*packsShowCmd) Name() string     { return "show" }
+func (*packsShowCmd) Synopsis() string { return "Show the manifest of a pack" }
+func (*packsShowCmd) Usage() string    { return "show [-data] [-worlds] <uuid>\n" }
+func (c *packsShowCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	packsShow(c.data, c.worlds, f.Arg(0))
+	return subcommands.ExitSuccess
+}
+
+type addonCmd struct{}
+
+func (*addonCmd) Name() string     { return "addon" }
+func (*addonCmd) Synopsis() string { return "Install .mcpack/.mcaddon files into a world" }
+func (*addonCmd) Usage() string {
+	return "addon <install|remove|list> [args]\n\tPlace the packs of an addon in a world and enable them\n"
+}
+func (*addonCmd) SetFlags(f *flag.FlagSet) {}
+func (*addonCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) (ret subcommands.ExitStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\033[5;91mError: \n", r)
+			ret = subcommands.ExitFailure
+		}
+	}()
+	cdr := subcommands.NewCommander(f, "addon")
+	cdr.Register(&addonInstallCmd{}, "")
+	cdr.Register(&addonRemoveCmd{}, "")
+	cdr.Register(&addonListCmd{}, "")
+	return cdr.Execute(ctx)
+}
+
+// addonTarget holds the flags shared by the addon subcommands
+type addonTarget struct {
+	profile string
+	world   string
+}
+
+func (t *addonTarget) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&t.profile, "profile", "default", "Game Profile")
+	f.StringVar(&t.world, "world", "", "World Directory Name (defaults to level-dir of the profile)")
+}
+
+type addonInstallCmd struct {
+	addonTarget
+}
+
+func (*addonInstallCmd) Name() string     { return "install" }
+func (*addonInstallCmd) Synopsis() string { return "Install and enable the packs of an addon" }
+func (*addonInstallCmd) Usage() string {
+	return "install [-profile] [-world] <file.mcaddon|file.mcpack>\n"
+}
+func (c *addonInstallCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	addonInstall(c.profile, c.world, f.Arg(0))
+	return subcommands.ExitSuccess
+}
+
+type addonRemoveCmd struct {
+	addonTarget
+	force bool
+}
+
+func (*addonRemoveCmd) Name() string     { return "remove" }
+func (*addonRemoveCmd) Synopsis() string { return "Disable and delete the packs of an installed addon" }
+func (*addonRemoveCmd) Usage() string {
+	return "remove [-profile] [-world] [-force] <addon|pack uuid>\n"
+}
+func (c *addonRemoveCmd) SetFlags(f *flag.FlagSet) {
+	c.addonTarget.SetFlags(f)
+	f.BoolVar(&c.force, "force", false, "Remove even if other packs depend on it")
+}
+func (c *addonRemoveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	addonRemove(c.profile, c.world, f.Arg(0), c.force)
+	return subcommands.ExitSuccess
+}
+
+type addonListCmd struct {
+	addonTarget
+}
+
+func (*addonListCmd) Name() string     { return "list" }
+func (*addonListCmd) Synopsis() string { return "List the addons installed in a world" }
+func (*addonListCmd) Usage() string    { return "list [-profile] [-world]\n" }
+func (c *addonListCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	addonList(c.profile, c.world)
+	return subcommands.ExitSuccess
+}
+
 type execCmd struct {
 	profile string
 	timeout int
@@ -193,12 +846,28 @@ func main() {
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	subcommands.Register(&unpackCmd{}, "")
+	subcommands.Register(&apkinfoCmd{}, "")
 	subcommands.Register(&attachCmd{}, "")
 	subcommands.Register(&runCmd{}, "")
 	subcommands.Register(&daemonCmd{}, "")
+	subcommands.Register(&stopCmd{}, "")
+	subcommands.Register(&historyCmd{}, "")
+	subcommands.Register(&statusCmd{}, "")
+	subcommands.Register(&killCmd{}, "")
+	subcommands.Register(&upCmd{}, "")
+	subcommands.Register(&downCmd{}, "")
+	subcommands.Register(&reloadCmd{}, "")
+	subcommands.Register(&scheduleCmd{}, "")
 	subcommands.Register(&execCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
+	subcommands.Register(&updateCmd{}, "")
+	subcommands.Register(&coreCmd{}, "")
+	subcommands.Register(&packsCmd{}, "")
+	subcommands.Register(&addonCmd{}, "")
 
+	if len(os.Args) > 1 && os.Args[1] == spawnHelper {
+		runSpawnHelper(os.Args[2:])
+	}
 	flag.Parse()
 	ctx := context.Background()
 	os.Exit(int(subcommands.Execute(ctx)))
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// notifier speaks the sd_notify protocol when running under a Type=notify unit
+type notifier struct {
+	enabled bool
+	ready   bool
+}
+
+func newNotifier(systemd bool) *notifier {
+	return &notifier{enabled: systemd && len(os.Getenv("NOTIFY_SOCKET")) > 0}
+}
+
+func (n *notifier) send(state string) {
+	if !n.enabled {
+		return
+	}
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		printWarn(fmt.Sprintf("Failed to notify systemd: %v", err))
+	}
+}
+
+func (n *notifier) status(format string, args ...interface{}) {
+	n.send("STATUS=" + fmt.Sprintf(format, args...))
+}
+
+// playerCount matches the "There are 1/40 players online:" answer of /list
+var playerCount = regexp.MustCompile(`(\d+)/(\d+)`)
+
+func formatUptime(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// reportStatus tells systemd the server is ready once it answers a ping, then keeps STATUS= up to date
+// until exited is closed
+func (n *notifier) reportStatus(profile string, b *bus, start time.Time, exited <-chan struct{}) {
+	n.status("Starting server")
+	every := 2 * time.Second
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(every):
+		}
+		if b.conn == nil && b.dial(profile) != nil {
+			continue
+		}
+		if _, err := b.pingWithin(5 * time.Second); err != nil {
+			continue
+		}
+		if !n.ready {
+			n.ready = true
+			n.send(daemon.SdNotifyReady)
+		}
+		every = 30 * time.Second
+		players := "players unknown"
+		if result, err := b.exec("list"); err == nil {
+			if match := playerCount.FindStringSubmatch(stripANSI(result)); match != nil {
+				players = fmt.Sprintf("%s/%s players online", match[1], match[2])
+			}
+		}
+		n.status("Running, %s, up %s", players, formatUptime(time.Since(start)))
+	}
+}
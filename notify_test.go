@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// listenNotify stands in for systemd's notify socket
+func listenNotify(t *testing.T) *net.UnixConn {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+	return conn
+}
+
+// received returns the next datagram, or "" if nothing arrives in time
+func received(conn *net.UnixConn, wait time.Duration) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn := listenNotify(t)
+	n := newNotifier(true)
+	if !n.enabled {
+		t.Fatal("notifier is disabled with NOTIFY_SOCKET set")
+	}
+	n.send(daemon.SdNotifyReady)
+	n.status("Running, %s, up %s", "2/10 players online", formatUptime(90*time.Minute))
+	n.send(daemon.SdNotifyStopping)
+	for _, want := range []string{"READY=1", "STATUS=Running, 2/10 players online, up 1h30m", "STOPPING=1"} {
+		if got := received(conn, time.Second); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	conn := listenNotify(t)
+	// without -systemd nothing is sent, even under a unit
+	n := newNotifier(false)
+	n.send(daemon.SdNotifyReady)
+	n.status("Starting server")
+	if got := received(conn, 100*time.Millisecond); len(got) > 0 {
+		t.Errorf("disabled notifier sent %q", got)
+	}
+	t.Setenv("NOTIFY_SOCKET", "")
+	if newNotifier(true).enabled {
+		t.Error("notifier is enabled without NOTIFY_SOCKET")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// packKinds are the pack folders the server loads, both in data/assets and in every world
+var packKinds = []string{"behavior_packs", "resource_packs"}
+
+// packVersion is written as [1, 0, 0] by most manifests and as "1.0.0" by newer ones
+type packVersion []int
+
+func (v *packVersion) UnmarshalJSON(data []byte) error {
+	var list []int
+	if err := json.Unmarshal(data, &list); err == nil {
+		*v = list
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("version must be [major, minor, patch] or \"major.minor.patch\": %s", data)
+	}
+	*v = nil
+	for _, part := range strings.Split(strings.SplitN(text, "-", 2)[0], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("bad version %q", text)
+		}
+		*v = append(*v, n)
+	}
+	return nil
+}
+
+func (v packVersion) String() string {
+	if len(v) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders versions component by component, missing components count as 0
+func (v packVersion) compare(other packVersion) int {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+type packModule struct {
+	Type    string      `json:"type"`
+	UUID    string      `json:"uuid"`
+	Version packVersion `json:"version"`
+}
+
+type packDependency struct {
+	UUID       string      `json:"uuid"`
+	ModuleName string      `json:"module_name"`
+	Version    packVersion `json:"version"`
+}
+
+type packManifest struct {
+	FormatVersion int `json:"format_version"`
+	Header        struct {
+		Name             string      `json:"name"`
+		Description      string      `json:"description"`
+		UUID             string      `json:"uuid"`
+		Version          packVersion `json:"version"`
+		MinEngineVersion packVersion `json:"min_engine_version"`
+	} `json:"header"`
+	Modules      []packModule     `json:"modules"`
+	Dependencies []packDependency `json:"dependencies"`
+}
+
+// pack is one pack folder found while scanning
+type pack struct {
+	manifest packManifest
+	dir      string
+	kind     string
+	origin   string
+}
+
+func (p *pack) uuid() string {
+	return strings.ToLower(p.manifest.Header.UUID)
+}
+
+// stripJSONComments removes the // and /* */ comments Minecraft tolerates in manifests
+func stripJSONComments(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			result = append(result, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				result = append(result, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '/' && i+1 < len(data) && data[i+1] == '/' {
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			result = append(result, '\n')
+			continue
+		}
+		if c == '/' && i+1 < len(data) && data[i+1] == '*' {
+			end := strings.Index(string(data[i+2:]), "*/")
+			if end < 0 {
+				break
+			}
+			i += end + 3
+			continue
+		}
+		if c == '"' {
+			inString = true
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func readPackManifest(dir string) (packManifest, error) {
+	var manifest packManifest
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return manifest, err
+	}
+	// some editors save manifests with a byte order mark
+	data = []byte(strings.TrimPrefix(string(data), "\ufeff"))
+	if err = json.Unmarshal(stripJSONComments(data), &manifest); err != nil {
+		return manifest, fmt.Errorf("manifest.json: %v", err)
+	}
+	if len(manifest.Header.UUID) == 0 {
+		return manifest, errors.New("manifest.json: no header uuid")
+	}
+	return manifest, nil
+}
+
+// scanPackDir reads every pack folder directly below root, warning about the broken ones
+func scanPackDir(root, kind, origin string) []*pack {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			printWarn(err.Error())
+		}
+		return nil
+	}
+	var packs []*pack
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		manifest, err := readPackManifest(dir)
+		if err != nil {
+			printWarn(fmt.Sprintf("Skipping %s: %v", dir, err))
+			continue
+		}
+		packs = append(packs, &pack{manifest: manifest, dir: dir, kind: kind, origin: origin})
+	}
+	return packs
+}
+
+// scanPacks collects the built-in packs of the unpacked data and the packs of every world
+func scanPacks(data, worlds string) []*pack {
+	var packs []*pack
+	for _, kind := range packKinds {
+		packs = append(packs, scanPackDir(filepath.Join(data, "assets", kind), kind, "built-in")...)
+	}
+	if dirs, err := ioutil.ReadDir(worlds); err == nil {
+		for _, world := range dirs {
+			if !world.IsDir() {
+				continue
+			}
+			for _, kind := range packKinds {
+				packs = append(packs, scanPackDir(filepath.Join(worlds, world.Name(), kind), kind, "world:"+world.Name())...)
+			}
+		}
+	}
+	return packs
+}
+
+// packCatalog indexes the scanned packs by uuid
+type packCatalog struct {
+	packs  []*pack
+	byUUID map[string][]*pack
+}
+
+func newPackCatalog(packs []*pack) *packCatalog {
+	c := &packCatalog{packs: packs, byUUID: map[string][]*pack{}}
+	for _, p := range packs {
+		c.byUUID[p.uuid()] = append(c.byUUID[p.uuid()], p)
+	}
+	sort.SliceStable(c.packs, func(i, j int) bool {
+		if c.packs[i].manifest.Header.Name != c.packs[j].manifest.Header.Name {
+			return c.packs[i].manifest.Header.Name < c.packs[j].manifest.Header.Name
+		}
+		return c.packs[i].dir < c.packs[j].dir
+	})
+	return c
+}
+
+// problems lists duplicate uuids and dependencies no scanned pack satisfies
+func (c *packCatalog) problems(p *pack) []string {
+	var result []string
+	if others := c.byUUID[p.uuid()]; len(others) > 1 {
+		var dirs []string
+		for _, other := range others {
+			if other != p {
+				dirs = append(dirs, other.dir)
+			}
+		}
+		result = append(result, fmt.Sprintf("duplicate uuid, also in %s", strings.Join(dirs, ", ")))
+	}
+	for _, dep := range p.manifest.Dependencies {
+		if len(dep.UUID) == 0 {
+			// script module dependencies (@minecraft/server, ...) are provided by the game
+			continue
+		}
+		if !c.satisfied(dep) {
+			result = append(result, fmt.Sprintf("unmet dependency %s %s", dep.UUID, dep.Version))
+		}
+	}
+	return result
+}
+
+func (c *packCatalog) satisfied(dep packDependency) bool {
+	for _, candidate := range c.byUUID[strings.ToLower(dep.UUID)] {
+		if candidate.manifest.Header.Version.compare(dep.Version) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func packsList(data, worlds string) {
+	catalog := newPackCatalog(scanPacks(data, worlds))
+	problems := 0
+	for _, p := range catalog.packs {
+		fmt.Printf("%-36s  %-8s  %-8s  %-16s  %s\n", p.uuid(), p.manifest.Header.Version,
+			strings.TrimSuffix(p.kind, "_packs"), p.origin, p.manifest.Header.Name)
+		for _, problem := range catalog.problems(p) {
+			printWarn("    " + problem)
+			problems++
+		}
+	}
+	printPair("Packs", fmt.Sprint(len(catalog.packs)))
+	if problems > 0 {
+		printPair("Problems", fmt.Sprint(problems))
+	}
+}
+
+func packsShow(data, worlds, uuid string) {
+	catalog := newPackCatalog(scanPacks(data, worlds))
+	found := catalog.byUUID[strings.ToLower(uuid)]
+	if len(found) == 0 {
+		panic(fmt.Errorf("no pack with uuid %s", uuid))
+	}
+	for i, p := range found {
+		if i > 0 {
+			fmt.Println()
+		}
+		header := p.manifest.Header
+		printPair("Name", header.Name)
+		if len(header.Description) > 0 {
+			printPair("Description", header.Description)
+		}
+		printPair("UUID", p.uuid())
+		printPair("Version", header.Version.String())
+		printPair("Min Engine", header.MinEngineVersion.String())
+		printPair("Kind", p.kind)
+		printPair("Origin", p.origin)
+		printPair("Path", p.dir)
+		for _, m := range p.manifest.Modules {
+			printPair("Module", fmt.Sprintf("%s %s %s", m.Type, m.UUID, m.Version))
+		}
+		for _, dep := range p.manifest.Dependencies {
+			name := dep.UUID
+			if len(name) == 0 {
+				name = dep.ModuleName
+			}
+			state := "ok"
+			if len(dep.UUID) > 0 && !catalog.satisfied(dep) {
+				state = "missing"
+			}
+			printPair("Dependency", fmt.Sprintf("%s %s (%s)", name, dep.Version, state))
+		}
+		for _, problem := range catalog.problems(p) {
+			printWarn(problem)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// detachedLockEnv hands the profile lock of a detaching daemon over to its detached copy
+const detachedLockEnv = "MCPESERVER_LOCK_FD"
+
+func pidFilePath(profile string) string {
+	return profile + ".pid"
+}
+
+// lockProfile takes the flock on <profile>.pid that keeps a second run or daemon of the profile
+// from starting, and records our pid in it; the lock goes away with the process. supervisor names
+// the up config when the profile runs inside an up process, whose pid is then the one recorded
+func lockProfile(profile, supervisor string) (*os.File, error) {
+	f, err := os.OpenFile(pidFilePath(profile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			if pid, _ := readPid(profile); pid > 0 {
+				return nil, fmt.Errorf("profile %s is already running (pid %d)", profile, pid)
+			}
+			return nil, fmt.Errorf("profile %s is already running", profile)
+		}
+		return nil, err
+	}
+	if err = writePid(f, supervisor); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// adoptProfileLock picks up the lock a detaching daemon passed on, if any
+func adoptProfileLock() *os.File {
+	fd, err := strconv.Atoi(os.Getenv(detachedLockEnv))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(detachedLockEnv)
+	f := os.NewFile(uintptr(fd), "lock")
+	syscall.CloseOnExec(fd)
+	if err := writePid(f, ""); err != nil {
+		printWarn(fmt.Sprintf("Failed to write the pid file: %v", err))
+	}
+	return f
+}
+
+func writePid(f *os.File, supervisor string) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	content := strconv.Itoa(os.Getpid()) + "\n"
+	if len(supervisor) > 0 {
+		content += "up " + supervisor + "\n"
+	}
+	_, err := f.WriteAt([]byte(content), 0)
+	return err
+}
+
+// unlockProfile empties the pid file so it does not point at a pid that may be reused
+func unlockProfile(f *os.File) {
+	f.Truncate(0)
+	f.Close()
+}
+
+func readPid(profile string) (int, error) {
+	data, err := ioutil.ReadFile(pidFilePath(profile))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]))
+}
+
+// pidSupervisor returns the up config the profile runs under, if it does
+func pidSupervisor(profile string) string {
+	data, err := ioutil.ReadFile(pidFilePath(profile))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "up ") {
+		return ""
+	}
+	return strings.TrimPrefix(lines[1], "up ")
+}
+
+// lockedPid returns the pid of the run or daemon holding the profile lock, 0 if there is none
+func lockedPid(profile string) int {
+	if !flockHeld(pidFilePath(profile)) {
+		// whatever pid is left in the file is stale
+		return 0
+	}
+	pid, _ := readPid(profile)
+	return pid
+}
+
+// flockHeld looks the file up in /proc/locks; taking the lock to find out, even briefly, would make
+// a run or daemon starting at the same moment think the profile is already running
+func flockHeld(file string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile("/proc/locks")
+	if err != nil {
+		return false
+	}
+	major := (st.Dev>>8)&0xfff | (st.Dev>>32)&^0xfff
+	minor := st.Dev&0xff | (st.Dev>>12)&^0xff
+	id := fmt.Sprintf("%02x:%02x:%d", major, minor, st.Ino)
+	for _, line := range strings.Split(string(data), "\n") {
+		// "1: FLOCK  ADVISORY  WRITE 8552 fe:00:9617509 0 EOF", waiters have "->" after the number
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		if fields[5] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// detach starts the daemon again in a session of its own with its output in the profile log and
+// hands it the profile lock, returning once it is running
+func detach(profile string, lock *os.File) {
+	log, err := os.OpenFile(profile+".log", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(fmt.Errorf("log file load failed: %v", err))
+	}
+	defer log.Close()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		panic(err)
+	}
+	defer null.Close()
+	self, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin = null
+	cmd.Stdout = log
+	cmd.Stderr = log
+	// the lock file becomes fd 3 of the child
+	cmd.ExtraFiles = []*os.File{lock}
+	cmd.Env = append(os.Environ(), detachedLockEnv+"=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		panic(err)
+	}
+	lock.Close()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	// the child writes its own pid into the file once it has taken the lock over
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited")
+			}
+			panic(fmt.Errorf("daemon failed to start (%v), check %s.log", err, profile))
+		case <-time.After(100 * time.Millisecond):
+		}
+		if pid, _ := readPid(profile); pid == cmd.Process.Pid {
+			break
+		}
+		if time.Now().After(deadline) {
+			panic(fmt.Errorf("daemon (pid %d) did not take over the profile within 5s, check %s.log", cmd.Process.Pid, profile))
+		}
+	}
+	printPair("Daemon", fmt.Sprintf("started, pid %d, logging to %s.log", cmd.Process.Pid, profile))
+}
+
+// serverPid asks D-Bus which process owns the profile's bus name
+func serverPid(profile string) (int, error) {
+	var b bus
+	if err := b.dial(profile); err != nil {
+		return 0, err
+	}
+	if _, err := b.pingWithin(5 * time.Second); err != nil {
+		return 0, err
+	}
+	return b.pid()
+}
+
+// printStatus shows what is running for the profile and reports whether anything is
+func printStatus(profile string) bool {
+	launcher := lockedPid(profile)
+	if supervisor := pidSupervisor(profile); launcher > 0 && len(supervisor) > 0 {
+		printPair("Launcher", fmt.Sprintf("supervised by up from %s, pid %d", supervisor, launcher))
+	} else if launcher > 0 {
+		printPair("Launcher", fmt.Sprintf("running, pid %d", launcher))
+	} else {
+		printPair("Launcher", "not running")
+	}
+	server, err := serverPid(profile)
+	if err == nil {
+		printPair("Server", fmt.Sprintf("answering on D-Bus, pid %d", server))
+	} else {
+		printPair("Server", fmt.Sprintf("not reachable over D-Bus (%v)", err))
+	}
+	if usage, ok := cgroupUsage(profile); ok {
+		printPair("Usage", usage)
+	}
+	if f, err := os.Open(profile + ".history"); err == nil {
+		f.Close()
+		printHistory(profile, 1)
+	}
+	return launcher > 0 || server > 0
+}
+
+// killProfile stops whatever runs the profile with sig, preferring the server's D-Bus owner and
+// falling back to the run or daemon in the pid file, which take the server down with them
+func killProfile(profile string, sig syscall.Signal, wait time.Duration) {
+	pid, err := serverPid(profile)
+	source := "D-Bus"
+	if err == nil {
+		// keep a supervising daemon from restarting the server
+		if f, err := os.Create(stopMarker(profile)); err == nil {
+			f.Close()
+		}
+	} else {
+		pid = lockedPid(profile)
+		source = pidFilePath(profile)
+		// that pid is the up process, signaling it would take down every profile it runs
+		if supervisor := pidSupervisor(profile); pid > 0 && len(supervisor) > 0 {
+			panic(fmt.Errorf("profile %s is supervised by up (pid %d) and its server does not answer on D-Bus; "+
+				"take it out of %s and run reload, or use down to stop them all", profile, pid, supervisor))
+		}
+	}
+	if pid <= 0 {
+		panic(fmt.Errorf("profile %s is not running", profile))
+	}
+	if err = syscall.Kill(pid, sig); err != nil {
+		os.Remove(stopMarker(profile))
+		panic(err)
+	}
+	printPair("Signaled", fmt.Sprintf("pid %d (from %s) with %v", pid, source, sig))
+	if wait <= 0 {
+		return
+	}
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if syscall.Kill(pid, 0) == syscall.ESRCH && lockedPid(profile) == 0 {
+			printInfo("Stopped.")
+			return
+		}
+	}
+	panic(fmt.Errorf("pid %d is still running after %v", pid, wait))
+}
+
+// signalNames are the signals kill accepts by name
+var signalNames = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"KILL": syscall.SIGKILL,
+	"QUIT": syscall.SIGQUIT,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
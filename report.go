@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// Output modes: text has colors and progress bars, plain is for logs, json emits one event per line
+const (
+	outputText  = "text"
+	outputPlain = "plain"
+	outputJSON  = "json"
+)
+
+var output = defaultOutput()
+
+func defaultOutput() string {
+	if isTerminal(os.Stdout) {
+		return outputText
+	}
+	return outputPlain
+}
+
+func setOutput(mode string) {
+	switch mode {
+	case "auto":
+		output = defaultOutput()
+	case outputText, outputPlain, outputJSON:
+		output = mode
+	default:
+		panic(fmt.Errorf("unknown output mode: %s", mode))
+	}
+}
+
+// event is one line of -output json
+type event struct {
+	Event   string      `json:"event"`
+	Command string      `json:"command,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	Action  string      `json:"action,omitempty"`
+	Size    uint64      `json:"size,omitempty"`
+	Current int64       `json:"current,omitempty"`
+	Total   int64       `json:"total,omitempty"`
+	Key     string      `json:"key,omitempty"`
+	Value   string      `json:"value,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Time    string      `json:"time"`
+}
+
+var eventLock sync.Mutex
+
+func emit(e event) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	json.NewEncoder(os.Stdout).Encode(e)
+}
+
+func reportStart(command string, data interface{}) {
+	if output == outputJSON {
+		emit(event{Event: "start", Command: command, Data: data})
+	}
+}
+
+func reportFile(path, action string, size uint64) {
+	if output == outputJSON {
+		emit(event{Event: "file", Path: path, Action: action, Size: size})
+	}
+}
+
+func reportDone(command string, data interface{}) {
+	if output == outputJSON {
+		emit(event{Event: "done", Command: command, Data: data})
+	}
+}
+
+// codedError carries one of the stable error codes of -output json
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e codedError) Error() string { return e.err.Error() }
+
+func withCode(code string, err error) error {
+	if _, ok := err.(codedError); ok {
+		return err
+	}
+	return codedError{code, err}
+}
+
+func errorCode(r interface{}) string {
+	switch err := r.(type) {
+	case codedError:
+		return err.code
+	case unsafeEntryError:
+		return "unsafe_entry"
+	}
+	return "internal"
+}
+
+// reportFailure prints what a command panicked with, in the current output mode
+func reportFailure(command string, r interface{}) {
+	switch output {
+	case outputJSON:
+		emit(event{Event: "error", Command: command, Code: errorCode(r), Message: fmt.Sprint(r)})
+	case outputPlain:
+		fmt.Printf("Error: [%s] %v\n", errorCode(r), r)
+	default:
+		fmt.Println("\033[5;91mError: ", r)
+	}
+}
+
+type progress interface {
+	io.Writer
+	Finish()
+}
+
+// newProgress shows a pb bar in text mode, percentage lines in plain mode and events in json mode
+func newProgress(prefix string, current, total int64) progress {
+	switch output {
+	case outputJSON:
+		return &stepProgress{prefix: prefix, current: current, total: total, last: -1, steps: 100, json: true}
+	case outputPlain:
+		return &stepProgress{prefix: prefix, current: current, total: total, last: -1, steps: 10}
+	}
+	bar := pb.New64(total)
+	bar.SetUnits(pb.U_BYTES_DEC)
+	bar.SetRefreshRate(time.Millisecond * 20)
+	bar.Prefix(prefix)
+	bar.Set64(current)
+	bar.Start()
+	return bar
+}
+
+// stepProgress reports every time another 1/steps of the total is done
+type stepProgress struct {
+	sync.Mutex
+	prefix  string
+	current int64
+	total   int64
+	last    int64
+	steps   int64
+	json    bool
+}
+
+func (p *stepProgress) report() {
+	if p.json {
+		emit(event{Event: "progress", Path: p.prefix, Current: p.current, Total: p.total})
+	} else if p.total > 0 {
+		fmt.Printf("%s: %d%% (%d/%d bytes)\n", p.prefix, p.current*100/p.total, p.current, p.total)
+	} else {
+		fmt.Printf("%s: %d bytes\n", p.prefix, p.current)
+	}
+}
+
+func (p *stepProgress) Write(data []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.current += int64(len(data))
+	if p.total > 0 {
+		if step := p.current * p.steps / p.total; step != p.last {
+			p.last = step
+			p.report()
+		}
+	}
+	return len(data), nil
+}
+
+func (p *stepProgress) Finish() {
+	p.Lock()
+	defer p.Unlock()
+	if p.total <= 0 || p.last < p.steps {
+		p.report()
+	}
+}
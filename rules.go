@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// defaultRules reproduces the filter unpack always had: keep what the server core needs
+// and drop textures, sounds and client-only assets.
+const defaultRules = `# first matching include/exclude wins, entries no rule matches are included
+# "*" stays inside one path segment, "**" crosses them
+exclude lib/x86/libfmod.so
+exclude res/**
+exclude org/**
+exclude assets/shaders/**
+exclude assets/skin_packs/**
+exclude assets/renderer/**
+exclude assets/animation/**
+exclude META-INF/**
+exclude **.png
+exclude **.fsb
+exclude **.ttf
+exclude **.jpg
+exclude **.txt
+exclude **.tga
+# top-level files (AndroidManifest.xml, classes.dex, ...)
+exclude *
+
+# rename <entry> <target>, or <dir>/ <dir>/ to move a whole directory
+rename lib/x86/libminecraftpe.so libs/libminecraftpe.so
+`
+
+type unpackRule struct {
+	action  string
+	pattern string
+	target  string
+	regexp  *regexp.Regexp
+	source  string
+	line    int
+}
+
+func (r unpackRule) String() string {
+	text := r.action + " " + r.pattern
+	if r.action == "rename" {
+		text += " " + r.target
+	}
+	return fmt.Sprintf("%s:%d: %s", r.source, r.line, text)
+}
+
+type unpackRules struct {
+	filters []unpackRule
+	renames []unpackRule
+}
+
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				buf.WriteString(".*")
+				i++
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+func parseRules(source, text string) (*unpackRules, error) {
+	rules := &unpackRules{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule := unpackRule{action: fields[0], source: source, line: line}
+		switch rule.action {
+		case "include", "exclude":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected \"%s <glob>\"", source, line, rule.action)
+			}
+			rule.pattern = fields[1]
+			re, err := globToRegexp(rule.pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", source, line, err)
+			}
+			rule.regexp = re
+			rules.filters = append(rules.filters, rule)
+		case "rename":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%s:%d: expected \"rename <from> <to>\"", source, line)
+			}
+			rule.pattern, rule.target = fields[1], fields[2]
+			if strings.HasSuffix(rule.pattern, "/") != strings.HasSuffix(rule.target, "/") {
+				return nil, fmt.Errorf("%s:%d: rename must map a file to a file or a dir/ to a dir/", source, line)
+			}
+			rules.renames = append(rules.renames, rule)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", source, line, rule.action)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// loadRules reads the rule file, or the built-in rules when file is empty
+func loadRules(file string) *unpackRules {
+	if len(file) == 0 {
+		rules, err := parseRules("built-in", defaultRules)
+		if err != nil {
+			panic(err)
+		}
+		return rules
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic(withCode("bad_rules", err))
+	}
+	rules, err := parseRules(file, string(data))
+	if err != nil {
+		panic(withCode("bad_rules", err))
+	}
+	return rules
+}
+
+// match returns the include/exclude rule that decides the entry, nil if none does
+func (rules *unpackRules) match(name string) *unpackRule {
+	for i := range rules.filters {
+		if rules.filters[i].regexp.MatchString(name) {
+			return &rules.filters[i]
+		}
+	}
+	return nil
+}
+
+// rename returns the target name of the entry and the rename rule that produced it, if any
+func (rules *unpackRules) rename(name string) (string, *unpackRule) {
+	for i, rule := range rules.renames {
+		if name == rule.pattern {
+			return rule.target, &rules.renames[i]
+		}
+		if strings.HasSuffix(rule.pattern, "/") && strings.HasPrefix(name, rule.pattern) {
+			return rule.target + strings.TrimPrefix(name, rule.pattern), &rules.renames[i]
+		}
+	}
+	return name, nil
+}
+
+// filter returns where the entry should be extracted to, or false if it is skipped
+func (rules *unpackRules) filter(name string) (string, bool) {
+	if rule := rules.match(name); rule != nil && rule.action == "exclude" {
+		return "", false
+	}
+	target, _ := rules.rename(name)
+	return target, true
+}
+
+func (rules *unpackRules) explain(name string) {
+	printPair("Entry", name)
+	rule := rules.match(name)
+	if rule == nil {
+		printPair("Rule", "(none, included by default)")
+	} else {
+		printPair("Rule", rule.String())
+		if rule.action == "exclude" {
+			printPair("Result", "skipped")
+			return
+		}
+	}
+	target, renamed := rules.rename(name)
+	if renamed != nil {
+		printPair("Rename", renamed.String())
+	}
+	printPair("Result", "extract to "+target)
+}
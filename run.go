@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"os/signal"
 	"os/user"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/kr/pty"
@@ -57,50 +60,75 @@ func packOutput(input io.Reader, output func(string)) {
 	}
 }
 
-func runImpl(done chan bool, profile string) (*os.File, func()) {
-	cmd := exec.Command("./bin/bedrockserver", profile)
-	cmd.Dir, _ = os.Getwd()
-	cmd.Env = append(cmd.Env, "LD_LIBRARY_PATH=./lib", "XDG_CACHE_HOME=./cache")
+// runImpl starts the server on a pty; done receives how it ended and exited is closed right before
+func runImpl(done chan procExit, profile string, config *profileConfig) (*os.File, *os.Process, <-chan struct{}, error) {
+	cmd, cg, err := serverCommand(profile, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	start := time.Now()
 	f, err := pty.Start(cmd)
 	if err != nil {
-		panic(err)
+		cg.remove()
+		return nil, nil, nil, err
 	}
-	status := true
-	selfLock := make(chan struct{}, 1)
+	exited := make(chan struct{})
 	go func() {
-		cmd.Wait()
-		selfLock <- struct{}{}
-		done <- status
+		err := cmd.Wait()
+		exit := newProcExit(start, cmd.ProcessState, err)
+		if config.Sandbox.Enabled {
+			exit.fromSandboxInit()
+		}
+		cg.account(&exit)
+		close(exited)
+		done <- exit
 	}()
-	return f, func() {
-		status = false
-		<-selfLock
-	}
+	return f, cmd.Process, exited, nil
 }
 
 var table = []string{"T", "D", "I", "N", "W", "E", "F"}
 
-func run(profile string, prompt *fasttemplate.Template) bool {
+// run starts the server with an interactive console and returns how it ended
+func run(profile string, config *profileConfig, prompt *fasttemplate.Template, stop stopOptions) procExit {
 	var bus bus
 	bus.init(profile)
 	defer bus.close()
 	_, err := bus.ping()
 	if err == nil {
-		printWarn("Server is started by other process")
-		return false
+		return procExit{Start: time.Now(), End: time.Now(), Code: -1, Error: "server is started by other process"}
 	}
 
 	log, err := os.OpenFile(profile+".log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		printWarn("Log File load failed")
-		return false
+		return procExit{Start: time.Now(), End: time.Now(), Code: -1, Error: fmt.Sprintf("log file load failed: %v", err)}
 	}
 	defer log.Close()
-	proc := make(chan bool, 1)
-	f, stop := runImpl(proc, profile)
+	os.Remove(stopMarker(profile))
+	defer os.Remove(stopMarker(profile))
+	proc := make(chan procExit, 1)
+	f, process, exited, err := runImpl(proc, profile, config)
+	if err != nil {
+		exit := newProcExit(time.Now(), nil, err)
+		recordExit(profile, exit)
+		return exit
+	}
 	defer f.Close()
-	defer stop()
-	defer bus.stop()
+	var stopping sync.Once
+	shutdown := func() {
+		stopping.Do(func() { gracefulStop(bus, process.Pid, stop, exited) })
+	}
+	// never leave the server running behind us, even if the console panics
+	defer shutdown()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			shutdown()
+		case <-exited:
+		}
+	}()
 	username := "nobody"
 	hostname := "bedrockserver"
 	{
@@ -174,7 +202,9 @@ func run(profile string, prompt *fasttemplate.Template) bool {
 			line = strings.TrimSpace(line)
 			execFn("console", line)
 		}
-		bus.stop()
+		shutdown()
 	}()
-	return <-proc
+	exit := <-proc
+	recordExit(profile, exit)
+	return exit
 }
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// sandboxConfig is the [sandbox] table of the profile config
+type sandboxConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	User     string   `toml:"user"`
+	Group    string   `toml:"group"`
+	ReadOnly []string `toml:"readonly"`
+	Writable []string `toml:"writable"`
+	// Allow takes syscalls off the denylist
+	Allow []string `toml:"allow"`
+
+	uid, gid int
+}
+
+func (s *sandboxConfig) check() error {
+	if !s.Enabled {
+		return nil
+	}
+	if s.ReadOnly == nil {
+		s.ReadOnly = []string{"bin", "lib", "data"}
+	}
+	if s.Writable == nil {
+		s.Writable = []string{"worlds", "cache"}
+	}
+	for _, dir := range append(append([]string{}, s.ReadOnly...), s.Writable...) {
+		if filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+			return fmt.Errorf("%q is not inside the server directory", dir)
+		}
+	}
+	if len(s.User) == 0 {
+		return errors.New("user is required, the server must not keep running as root")
+	}
+	u, err := user.Lookup(s.User)
+	if err != nil {
+		if u, err = user.LookupId(s.User); err != nil {
+			return fmt.Errorf("unknown user %q", s.User)
+		}
+	}
+	s.uid, _ = strconv.Atoi(u.Uid)
+	s.gid, _ = strconv.Atoi(u.Gid)
+	if len(s.Group) > 0 {
+		g, err := user.LookupGroup(s.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(s.Group); err != nil {
+				return fmt.Errorf("unknown group %q", s.Group)
+			}
+		}
+		s.gid, _ = strconv.Atoi(g.Gid)
+	}
+	if s.uid == 0 {
+		return errors.New("user must not be root")
+	}
+	for _, name := range s.Allow {
+		if _, ok := deniedSyscalls[name]; !ok {
+			return fmt.Errorf("%q is not on the syscall denylist", name)
+		}
+	}
+	return nil
+}
+
+const (
+	prGetSeccomp      = 21
+	prSetSeccomp      = 22
+	prSetNoNewPrivs   = 38
+	seccompModeFilter = 2
+
+	oPath = 0x200000 // O_PATH, missing from package syscall
+)
+
+// prepare checks that the sandbox can be set up here and returns the spawn helper arguments;
+// anything missing is an error rather than a weaker sandbox
+func (s *sandboxConfig) prepare() ([]string, error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("the sandbox needs mcpeserver to be started as root")
+	}
+	for _, ns := range []string{"mnt", "pid", "ipc"} {
+		if _, err := os.Stat("/proc/self/ns/" + ns); err != nil {
+			return nil, fmt.Errorf("the kernel does not support %s namespaces", ns)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetSeccomp, 0, 0); errno == syscall.EINVAL {
+		return nil, errors.New("the kernel does not support seccomp")
+	}
+	args := []string{"-sandbox", "-uid", strconv.Itoa(s.uid), "-gid", strconv.Itoa(s.gid)}
+	for _, dir := range s.ReadOnly {
+		args = append(args, "-ro", dir)
+	}
+	for _, dir := range s.Writable {
+		args = append(args, "-rw", dir)
+	}
+	for _, name := range s.Allow {
+		args = append(args, "-allow", name)
+	}
+	return args, nil
+}
+
+func (s *sandboxConfig) cloneflags() uintptr {
+	return syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC
+}
+
+// deniedSyscalls are kept from the server, numbered for x86_64 and i386 (-1 where there is none);
+// the core is an i386 binary that runs on both
+var deniedSyscalls = map[string][2]int{
+	"mount":             {165, 21},
+	"umount":            {-1, 22},
+	"umount2":           {166, 52},
+	"pivot_root":        {155, 217},
+	"chroot":            {161, 61},
+	"swapon":            {167, 87},
+	"swapoff":           {168, 115},
+	"reboot":            {169, 88},
+	"sethostname":       {170, 74},
+	"setdomainname":     {171, 121},
+	"init_module":       {175, 128},
+	"finit_module":      {313, 350},
+	"delete_module":     {176, 129},
+	"kexec_load":        {246, 283},
+	"kexec_file_load":   {320, -1},
+	"ptrace":            {101, 26},
+	"process_vm_readv":  {310, 347},
+	"process_vm_writev": {311, 348},
+	"bpf":               {321, 357},
+	"perf_event_open":   {298, 336},
+	"keyctl":            {250, 288},
+	"add_key":           {248, 286},
+	"request_key":       {249, 287},
+	"unshare":           {272, 310},
+	"setns":             {308, 346},
+	"acct":              {163, 51},
+	"userfaultfd":       {323, 374},
+	"name_to_handle_at": {303, 341},
+	"open_by_handle_at": {304, 342},
+	"iopl":              {172, 110},
+	"ioperm":            {173, 101},
+	"vm86":              {-1, 166},
+	"vm86old":           {-1, 113},
+	"quotactl":          {179, 131},
+	"lookup_dcookie":    {212, 253},
+	"open_tree":         {428, 428},
+	"move_mount":        {429, 429},
+	"fsopen":            {430, 430},
+	"fsconfig":          {431, 431},
+	"fsmount":           {432, 432},
+	"fspick":            {433, 433},
+	"mount_setattr":     {442, 442},
+}
+
+const (
+	bpfLdAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeq    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJge    = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfJset   = 0x45 // BPF_JMP | BPF_JSET | BPF_K
+	bpfRet    = 0x06 // BPF_RET | BPF_K
+	auditX64  = 0xc000003e
+	auditI386 = 0x40000003
+	x32Bit    = 0x40000000
+
+	seccompRetKill  = 0x80000000 // SECCOMP_RET_KILL_PROCESS
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	// cloneNamespaces are the CLONE_NEW* flags, clone may not do what unshare is denied
+	cloneNamespaces = syscall.CLONE_NEWNS | syscall.CLONE_NEWCGROUP | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC |
+		syscall.CLONE_NEWUSER | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET
+)
+
+// cloneSyscalls are clone and clone3 on x86_64 and i386; the flags of clone3 are in a struct
+// the filter cannot look into, so it fails with ENOSYS and the C library falls back to clone
+var cloneSyscalls = [2][2]uint32{{56, 435}, {120, 435}}
+
+// seccompFilter builds a BPF program that fails the denied syscalls with EPERM on both
+// architectures and kills the process on any other
+func seccompFilter(allow []string) []syscall.SockFilter {
+	allowed := map[string]bool{}
+	for _, name := range allow {
+		allowed[name] = true
+	}
+	var names []string
+	for name := range deniedSyscalls {
+		if !allowed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// jumps to the deny and nosys returns at the end are filled in once their place is known
+	const (
+		toDeny = iota + 1
+		toNosys
+	)
+	var prog []syscall.SockFilter
+	jumps := map[int]int{}
+	block := func(arch int) ([]syscall.SockFilter, map[int]int) {
+		var b []syscall.SockFilter
+		to := map[int]int{}
+		jump := func(ins syscall.SockFilter, target int) {
+			to[len(b)] = target
+			b = append(b, ins)
+		}
+		b = append(b, syscall.SockFilter{Code: bpfLdAbs, K: 0})
+		if arch == 0 {
+			// x32 syscalls arrive as x86_64 with this bit set, none of them are allowed
+			jump(syscall.SockFilter{Code: bpfJge, K: x32Bit}, toDeny)
+		}
+		for _, name := range names {
+			if nr := deniedSyscalls[name][arch]; nr >= 0 {
+				jump(syscall.SockFilter{Code: bpfJeq, K: uint32(nr)}, toDeny)
+			}
+		}
+		if !allowed["unshare"] {
+			clone, clone3 := cloneSyscalls[arch][0], cloneSyscalls[arch][1]
+			jump(syscall.SockFilter{Code: bpfJeq, K: clone3}, toNosys)
+			// not clone: skip over the check of its flags, the first argument
+			b = append(b, syscall.SockFilter{Code: bpfJeq, K: clone, Jf: 2})
+			b = append(b, syscall.SockFilter{Code: bpfLdAbs, K: 16})
+			jump(syscall.SockFilter{Code: bpfJset, K: cloneNamespaces}, toDeny)
+		}
+		return append(b, syscall.SockFilter{Code: bpfRet, K: seccompRetAllow}), to
+	}
+	prog = append(prog, syscall.SockFilter{Code: bpfLdAbs, K: 4})
+	for arch, audit := range []uint32{auditX64, auditI386} {
+		b, to := block(arch)
+		prog = append(prog, syscall.SockFilter{Code: bpfJeq, K: audit, Jf: uint8(len(b))})
+		for i, target := range to {
+			jumps[len(prog)+i] = target
+		}
+		prog = append(prog, b...)
+	}
+	prog = append(prog, syscall.SockFilter{Code: bpfRet, K: seccompRetKill})
+	targets := map[int]int{toDeny: len(prog), toNosys: len(prog) + 1}
+	prog = append(prog, syscall.SockFilter{Code: bpfRet, K: seccompRetErrno | uint32(syscall.EPERM)})
+	prog = append(prog, syscall.SockFilter{Code: bpfRet, K: seccompRetErrno | uint32(syscall.ENOSYS)})
+	for i, target := range jumps {
+		prog[i].Jt = uint8(targets[target] - i - 1)
+	}
+	return prog
+}
+
+// mountFlags are the per-mount options of /proc/self/mountinfo that a remount has to repeat
+var mountFlags = map[string]uintptr{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+// mountPoints lists the mounts of our namespace with their flags
+func mountPoints() (map[string]uintptr, error) {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mounts := map[string]uintptr{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue"
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		var flags uintptr
+		for _, option := range strings.Split(fields[5], ",") {
+			flags |= mountFlags[option]
+		}
+		mounts[unescapeMountPath(fields[4])] = flags
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escapes of spaces, tabs, newlines and backslashes in mountinfo
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func below(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// enterSandbox runs in the spawn helper, which was cloned into new mount, PID and IPC namespaces
+// as root: it makes the whole file system read-only except for the writable directories and a
+// tmpfs of its own on /tmp, drops to the configured user and installs the seccomp filter on the
+// thread that goes on to start the server
+func enterSandbox(uid, gid int, readonly, writable, allow []string) error {
+	runtime.LockOSThread()
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	mount := func(source, target, fstype string, flags uintptr, data string) error {
+		if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+			return fmt.Errorf("mount %s: %v", target, err)
+		}
+		return nil
+	}
+	// keep our mounts from leaking back to the host
+	if err := mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if err := mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	for _, rw := range writable {
+		if _, err := os.Stat(rw); os.IsNotExist(err) {
+			if err := os.MkdirAll(rw, 0755); err != nil {
+				return err
+			}
+			os.Chown(rw, uid, gid)
+		}
+	}
+
+	// the directory, and the core that bin usually links to, may be below /tmp; hold on to them so
+	// they can be bound again on top of the new tmpfs
+	visible := map[string]int{}
+	for _, path := range append(append([]string{"."}, readonly...), writable...) {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+		if err != nil {
+			continue
+		}
+		if _, seen := visible[resolved]; seen || !below(resolved, "/tmp") {
+			continue
+		}
+		fd, err := syscall.Open(resolved, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("open %s: %v", resolved, err)
+		}
+		defer syscall.Close(fd)
+		visible[resolved] = fd
+	}
+	if err := mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+	// shorter paths first, so a directory is back before what lies below it
+	var kept []string
+	for path := range visible {
+		kept = append(kept, path)
+	}
+	sort.Strings(kept)
+	for _, path := range kept {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		if err := mount(fmt.Sprintf("/proc/self/fd/%d", visible[path]), path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+	// the working directory still points below the mounts we just covered, step into the new ones
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	for _, rw := range writable {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(dir, rw))
+		if err != nil {
+			return err
+		}
+		// a mount of its own stays writable when everything around it is made read-only
+		if err := mount(resolved, resolved, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+		keep[resolved] = true
+	}
+	for _, ro := range readonly {
+		if _, err := os.Stat(ro); os.IsNotExist(err) {
+			continue
+		}
+		// bin is usually a link to the core outside the directory
+		if err := mount(ro, ro, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for path, flags := range mounts {
+		// the new tmpfs itself is writable, what was bound again on top of it is not
+		writable := path == "/tmp"
+		for kept := range keep {
+			writable = writable || below(path, kept)
+		}
+		// the mounts of the old /tmp are out of reach under the tmpfs, unless bound again over it
+		hidden := !writable && below(path, "/tmp")
+		for back := range visible {
+			hidden = hidden && !below(path, back)
+		}
+		// proc was mounted for the namespace above and stays as it is
+		if writable || hidden || below(path, "/proc") {
+			continue
+		}
+		if err := mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|flags, ""); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %v", uid, err)
+	}
+	if os.Geteuid() != uid || os.Getegid() != gid {
+		return errors.New("failed to drop privileges")
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs: %v", errno)
+	}
+	filter := seccompFilter(allow)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("seccomp filter: %v", errno)
+	}
+	return nil
+}
+
+// initSignaled and initCoreDumped are added to the signal number in the exit code of the sandbox
+// init when the server was killed; the init is PID 1 of its namespace and cannot die by the signal itself
+const (
+	initSignaled   = 128
+	initCoreDumped = 192
+)
+
+// runInit stays in the sandbox as PID 1: the kernel drops signals to PID 1 that it has no handler
+// for, so it passes them on to the server, reaps whatever is orphaned in the namespace and exits
+// with the server's status; it has to run on the thread that installed the seccomp filter
+func runInit(binary string, args []string) error {
+	signals := make(chan os.Signal, 16)
+	forwarded := []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+	signal.Notify(signals, append(forwarded, syscall.SIGCHLD)...)
+	pid, err := syscall.ForkExec(binary, args, &syscall.ProcAttr{Env: os.Environ(), Files: []uintptr{0, 1, 2}})
+	if err != nil {
+		return err
+	}
+	for sig := range signals {
+		if sig != syscall.SIGCHLD {
+			syscall.Kill(pid, sig.(syscall.Signal))
+			continue
+		}
+		for {
+			var ws syscall.WaitStatus
+			reaped, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+			if err != nil || reaped <= 0 {
+				break
+			}
+			if reaped != pid {
+				continue
+			}
+			// the rest of the namespace is killed once we exit
+			switch {
+			case ws.Signaled() && ws.CoreDump():
+				os.Exit(initCoreDumped + int(ws.Signal()))
+			case ws.Signaled():
+				os.Exit(initSignaled + int(ws.Signal()))
+			}
+			os.Exit(ws.ExitStatus())
+		}
+	}
+	return nil
+}
+
+// fromSandboxInit turns the exit code runInit reports a killed server with back into the signal
+func (e *procExit) fromSandboxInit() {
+	switch {
+	case e.Code > initCoreDumped && e.Code < 256:
+		e.Signal, e.CoreDump = e.Code-initCoreDumped, true
+	case e.Code > initSignaled && e.Code <= initCoreDumped:
+		e.Signal = e.Code - initSignaled
+	default:
+		return
+	}
+	e.Code = -1
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+// runFilter interprets the few BPF instructions seccompFilter uses over a seccomp_data
+// of the given architecture, syscall and first argument
+func runFilter(t *testing.T, prog []syscall.SockFilter, arch, nr uint32, arg uint64) uint32 {
+	data := map[uint32]uint32{0: nr, 4: arch, 16: uint32(arg), 20: uint32(arg >> 32)}
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		taken := false
+		switch ins.Code {
+		case bpfLdAbs:
+			acc = data[ins.K]
+			continue
+		case bpfRet:
+			return ins.K
+		case bpfJeq:
+			taken = acc == ins.K
+		case bpfJge:
+			taken = acc >= ins.K
+		case bpfJset:
+			taken = acc&ins.K != 0
+		default:
+			t.Fatalf("unexpected instruction %#x at %d", ins.Code, pc)
+		}
+		if taken {
+			pc += int(ins.Jt)
+		} else {
+			pc += int(ins.Jf)
+		}
+	}
+	t.Fatal("the filter ran off its end")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	eperm := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	enosys := uint32(seccompRetErrno | uint32(syscall.ENOSYS))
+	tests := []struct {
+		name  string
+		allow []string
+		arch  uint32
+		nr    uint32
+		arg   uint64
+		want  uint32
+	}{
+		{"read", nil, auditX64, 0, 0, seccompRetAllow},
+		{"mount", nil, auditX64, 165, 0, eperm},
+		{"mount on i386", nil, auditI386, 21, 0, eperm},
+		{"allowed ptrace", []string{"ptrace"}, auditX64, 101, 0, seccompRetAllow},
+		{"x32 read", nil, auditX64, x32Bit, 0, eperm},
+		{"other architecture", nil, 0xc00000b7, 0, 0, seccompRetKill},
+		{"clone of a thread", nil, auditX64, 56, syscall.CLONE_VM | syscall.CLONE_THREAD, seccompRetAllow},
+		{"clone into a user namespace", nil, auditX64, 56, syscall.CLONE_NEWUSER, eperm},
+		{"clone into a mount namespace on i386", nil, auditI386, 120, syscall.CLONE_NEWNS | uint64(syscall.SIGCHLD), eperm},
+		{"clone3", nil, auditX64, 435, 0, enosys},
+		{"clone3 on i386", nil, auditI386, 435, 0, enosys},
+		{"clone with unshare allowed", []string{"unshare"}, auditX64, 56, syscall.CLONE_NEWUSER, seccompRetAllow},
+	}
+	for _, test := range tests {
+		if got := runFilter(t, seccompFilter(test.allow), test.arch, test.nr, test.arg); got != test.want {
+			t.Errorf("%s: got %#x, want %#x", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scheduleEntry is one [[schedule]] table of the profile config
+type scheduleEntry struct {
+	Name     string   `toml:"name"`
+	Cron     string   `toml:"cron"`
+	Every    duration `toml:"every"`
+	Action   string   `toml:"action"`
+	Command  string   `toml:"command"`
+	Messages []string `toml:"messages"`
+	Announce string   `toml:"announce"`
+	Delay    duration `toml:"delay"`
+	Dir      string   `toml:"dir"`
+	Keep     int      `toml:"keep"`
+
+	cron *cronSpec
+}
+
+func (entry *scheduleEntry) check() (err error) {
+	if len(entry.Name) == 0 {
+		return errors.New("name is required")
+	}
+	switch {
+	case len(entry.Cron) > 0 && entry.Every.Duration > 0:
+		return errors.New("use either cron or every, not both")
+	case len(entry.Cron) > 0:
+		if entry.cron, err = parseCron(entry.Cron); err != nil {
+			return err
+		}
+	case entry.Every.Duration >= time.Minute:
+	case entry.Every.Duration > 0:
+		return errors.New("every must be at least 1m")
+	default:
+		return errors.New("cron or every is required")
+	}
+	switch entry.Action {
+	case "exec":
+		if len(entry.Command) == 0 {
+			return errors.New("exec needs a command")
+		}
+	case "announce":
+		if len(entry.Messages) == 0 {
+			return errors.New("announce needs messages")
+		}
+	case "restart", "backup":
+	default:
+		return fmt.Errorf("unknown action %q (exec, restart, backup, announce)", entry.Action)
+	}
+	switch entry.Announce {
+	case "":
+		entry.Announce = "say"
+	case "say", "title":
+	default:
+		return fmt.Errorf("unknown announce method %q", entry.Announce)
+	}
+	if len(entry.Dir) == 0 {
+		entry.Dir = "backups"
+	}
+	return nil
+}
+
+func (entry *scheduleEntry) when() string {
+	if entry.cron != nil {
+		return "cron " + entry.Cron
+	}
+	return "every " + entry.Every.String()
+}
+
+// next is when the entry runs after last (its previous run, zero if it never ran) as seen at now
+func (entry *scheduleEntry) next(last, now time.Time) time.Time {
+	if entry.cron != nil {
+		return entry.cron.next(now)
+	}
+	if last.IsZero() {
+		return now.Add(entry.Every.Duration)
+	}
+	next := last.Add(entry.Every.Duration)
+	if next.Before(now) {
+		// missed while the daemon was down, run soon but do not catch up on every missed run
+		return now
+	}
+	return next
+}
+
+// scheduleState survives daemon restarts in <profile>.schedule.json
+type scheduleState struct {
+	LastRun time.Time `json:"last_run"`
+	Result  string    `json:"result"`
+	Runs    int       `json:"runs"`
+	// Rotation is the next message of an announce entry
+	Rotation int `json:"rotation,omitempty"`
+}
+
+var scheduleStateLock sync.Mutex
+
+func scheduleStatePath(profile string) string {
+	return profile + ".schedule.json"
+}
+
+func loadScheduleState(profile string) map[string]scheduleState {
+	state := map[string]scheduleState{}
+	if data, err := ioutil.ReadFile(scheduleStatePath(profile)); err == nil {
+		if err = json.Unmarshal(data, &state); err != nil {
+			printWarn(fmt.Sprintf("Ignoring broken %s: %v", scheduleStatePath(profile), err))
+		}
+	}
+	return state
+}
+
+// runScheduled runs an entry and records the run in the state file and the profile log
+func runScheduled(profile string, entry *scheduleEntry, b *bus) (err error) {
+	scheduleStateLock.Lock()
+	state := loadScheduleState(profile)
+	scheduleStateLock.Unlock()
+	current := state[entry.Name]
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		current.LastRun = time.Now()
+		current.Runs++
+		current.Result = "ok"
+		if err != nil {
+			current.Result = err.Error()
+			logEvent(profile, "schedule %s (%s) failed: %v", entry.Name, entry.Action, err)
+		} else {
+			logEvent(profile, "schedule %s (%s) done", entry.Name, entry.Action)
+		}
+		scheduleStateLock.Lock()
+		defer scheduleStateLock.Unlock()
+		state := loadScheduleState(profile)
+		state[entry.Name] = current
+		if serr := saveJSON(scheduleStatePath(profile), state); serr != nil {
+			printWarn(fmt.Sprintf("Failed to save %s: %v", scheduleStatePath(profile), serr))
+		}
+	}()
+	logEvent(profile, "schedule %s (%s) started", entry.Name, entry.Action)
+	if b.conn == nil {
+		if err := b.dial(profile); err != nil {
+			return err
+		}
+	}
+	if _, err := b.ping(); err != nil {
+		// the connection itself may be what failed, as after a restart of the bus daemon
+		if derr := b.redial(profile); derr != nil {
+			return fmt.Errorf("server is not running: %v (reconnecting: %v)", err, derr)
+		}
+		if _, err = b.ping(); err != nil {
+			return fmt.Errorf("server is not running: %v", err)
+		}
+	}
+	switch entry.Action {
+	case "exec":
+		result, err := b.exec(entry.Command)
+		if err != nil {
+			return err
+		}
+		if len(result) > 0 {
+			logEvent(profile, "schedule %s: %s", entry.Name, stripANSI(replacer.Replace(result)))
+		}
+	case "announce":
+		message := entry.Messages[current.Rotation%len(entry.Messages)]
+		current.Rotation = (current.Rotation + 1) % len(entry.Messages)
+		command := "/say " + message
+		if entry.Announce == "title" {
+			command = "/title @a title " + message
+		}
+		if _, err := b.exec(command); err != nil {
+			return err
+		}
+	case "restart":
+		message := "Server restarts in {{time}}"
+		if len(entry.Messages) > 0 {
+			message = entry.Messages[0]
+		}
+		shutdownServer(*b, stopOptions{delay: entry.Delay.Duration, message: message, announce: entry.Announce,
+			timeout: 30 * time.Second, killTimeout: 10 * time.Second, marker: restartMarker(profile)})
+	case "backup":
+		file, err := backupWorld(profile, *b, entry.Dir, entry.Keep)
+		if err != nil {
+			return err
+		}
+		logEvent(profile, "schedule %s: wrote %s", entry.Name, file)
+	}
+	return nil
+}
+
+// scheduler runs the entries of the profile config while the daemon supervises the server
+type scheduler struct {
+	profile string
+	entries []*scheduleEntry
+	bus     bus
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func startScheduler(profile string, config *profileConfig) *scheduler {
+	s := &scheduler{profile: profile, quit: make(chan struct{}), done: make(chan struct{})}
+	for i := range config.Schedule {
+		s.entries = append(s.entries, &config.Schedule[i])
+	}
+	if len(s.entries) == 0 {
+		close(s.done)
+		return s
+	}
+	go s.loop()
+	return s
+}
+
+func (s *scheduler) stop() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	close(s.quit)
+	<-s.done
+}
+
+func (s *scheduler) loop() {
+	defer close(s.done)
+	// the shared connection is used by the watchdog and the notifier as well
+	defer s.bus.release()
+	next := map[*scheduleEntry]time.Time{}
+	state := loadScheduleState(s.profile)
+	now := time.Now()
+	for _, entry := range s.entries {
+		next[entry] = entry.next(state[entry.Name].LastRun, now)
+	}
+	for {
+		var due *scheduleEntry
+		for _, entry := range s.entries {
+			if !next[entry].IsZero() && (due == nil || next[entry].Before(next[due])) {
+				due = entry
+			}
+		}
+		if due == nil {
+			return
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-time.After(time.Until(next[due])):
+		}
+		if err := runScheduled(s.profile, due, &s.bus); err != nil {
+			printWarn(fmt.Sprintf("Schedule %s failed: %v", due.Name, err))
+		}
+		next[due] = due.next(time.Now(), time.Now())
+	}
+}
+
+type scheduleRow struct {
+	entry *scheduleEntry
+	state scheduleState
+	next  time.Time
+}
+
+func scheduleRows(profile string) []scheduleRow {
+	config := loadProfileConfig(profile)
+	state := loadScheduleState(profile)
+	now := time.Now()
+	var rows []scheduleRow
+	for i := range config.Schedule {
+		entry := &config.Schedule[i]
+		rows = append(rows, scheduleRow{entry, state[entry.Name], entry.next(state[entry.Name].LastRun, now)})
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].next.Before(rows[j].next) })
+	return rows
+}
+
+func formatScheduleTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func scheduleList(profile string) {
+	rows := scheduleRows(profile)
+	if len(rows) == 0 {
+		printInfo(fmt.Sprintf("No schedule entries in %s", profileConfigPath(profile)))
+		return
+	}
+	for _, row := range rows {
+		printPair(row.entry.Name, fmt.Sprintf("%s, %s", row.entry.Action, row.entry.when()))
+		fmt.Printf("    next %s, last %s", formatScheduleTime(row.next), formatScheduleTime(row.state.LastRun))
+		if len(row.state.Result) > 0 {
+			fmt.Printf(" (%s)", row.state.Result)
+		}
+		fmt.Println()
+	}
+}
+
+func scheduleNext(profile string) {
+	rows := scheduleRows(profile)
+	if len(rows) == 0 || rows[0].next.IsZero() {
+		printInfo("Nothing scheduled")
+		return
+	}
+	printPair(rows[0].entry.Name, fmt.Sprintf("%s at %s (in %v)", rows[0].entry.Action,
+		formatScheduleTime(rows[0].next), time.Until(rows[0].next).Round(time.Second)))
+}
+
+func scheduleRunNow(profile, name string) {
+	config := loadProfileConfig(profile)
+	for i := range config.Schedule {
+		if entry := &config.Schedule[i]; entry.Name == name {
+			var b bus
+			b.init(profile)
+			defer b.close()
+			if err := runScheduled(profile, entry, &b); err != nil {
+				panic(err)
+			}
+			printInfo(fmt.Sprintf("Ran %s.", name))
+			return
+		}
+	}
+	panic(fmt.Errorf("no schedule entry %q in %s", name, profileConfigPath(profile)))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasttemplate"
+)
+
+// stopOptions controls how the server is brought down: announce, ask it to stop, then escalate
+type stopOptions struct {
+	delay       time.Duration
+	message     string
+	announce    string // say or title
+	timeout     time.Duration
+	killTimeout time.Duration
+	// marker is created right before the stop request, a countdown cut short leaves none behind
+	marker string
+}
+
+func (o *stopOptions) setFlags(f *flag.FlagSet, delay time.Duration) {
+	f.DurationVar(&o.delay, "delay", delay, "Countdown Before Stopping")
+	f.StringVar(&o.message, "message", "Server stops in {{time}}", "Countdown Message Template")
+	f.StringVar(&o.announce, "announce", "say", "Announce With (say, title)")
+	f.DurationVar(&o.timeout, "timeout", 30*time.Second, "Time To Wait For A Clean Stop Before SIGTERM")
+	f.DurationVar(&o.killTimeout, "kill-timeout", 10*time.Second, "Time To Wait After SIGTERM Before SIGKILL")
+}
+
+// countdownMarks are the remaining times at which the countdown is announced
+var countdownMarks = []time.Duration{
+	10 * time.Minute, 5 * time.Minute, 2 * time.Minute, time.Minute,
+	30 * time.Second, 10 * time.Second, 5 * time.Second, 4 * time.Second,
+	3 * time.Second, 2 * time.Second, time.Second,
+}
+
+func isCountdownMark(d time.Duration) bool {
+	for _, mark := range countdownMarks {
+		if d == mark {
+			return true
+		}
+	}
+	return false
+}
+
+func formatRemaining(d time.Duration) string {
+	if d >= time.Minute && d%time.Minute == 0 {
+		if d == time.Minute {
+			return "1 minute"
+		}
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	}
+	if d == time.Second {
+		return "1 second"
+	}
+	return fmt.Sprintf("%d seconds", d/time.Second)
+}
+
+func (o stopOptions) announceCommand(remaining time.Duration) string {
+	text := fasttemplate.New(o.message, "{{", "}}").ExecuteString(map[string]interface{}{
+		"time":    formatRemaining(remaining),
+		"seconds": fmt.Sprint(int(remaining / time.Second)),
+	})
+	text = strings.Replace(text, "\n", " ", -1)
+	if o.announce == "title" {
+		return "/title @a title " + text
+	}
+	return "/say " + text
+}
+
+// watchPid closes the returned channel once the process is gone
+func watchPid(pid int) <-chan struct{} {
+	exited := make(chan struct{})
+	go func() {
+		// EPERM means the pid now belongs to someone else, the process we could signal is gone
+		for syscall.Kill(pid, 0) == nil {
+			time.Sleep(200 * time.Millisecond)
+		}
+		close(exited)
+	}()
+	return exited
+}
+
+func waitExit(exited <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-exited:
+		return true
+	default:
+	}
+	select {
+	case <-exited:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// gracefulStop counts down, asks the core to stop over D-Bus and then escalates to SIGTERM and
+// SIGKILL; it returns once exited is closed
+func gracefulStop(b bus, pid int, opts stopOptions, exited <-chan struct{}) {
+	if waitExit(exited, 0) {
+		return
+	}
+	remaining := opts.delay
+	if remaining > 0 && !isCountdownMark(remaining) {
+		if _, err := b.exec(opts.announceCommand(remaining)); err != nil {
+			printWarn(fmt.Sprintf("Announcement failed: %v", err))
+		}
+	}
+	for _, mark := range countdownMarks {
+		if mark > remaining {
+			continue
+		}
+		if waitExit(exited, remaining-mark) {
+			return
+		}
+		remaining = mark
+		if _, err := b.exec(opts.announceCommand(remaining)); err != nil {
+			printWarn(fmt.Sprintf("Announcement failed: %v", err))
+		}
+	}
+	if waitExit(exited, remaining) {
+		return
+	}
+	printInfo("Stopping server...")
+	if len(opts.marker) > 0 {
+		if f, err := os.Create(opts.marker); err == nil {
+			f.Close()
+		}
+	}
+	if err := b.stop(); err != nil {
+		printWarn(fmt.Sprintf("Stop request failed: %v", err))
+	}
+	if waitExit(exited, opts.timeout) {
+		return
+	}
+	if pid <= 0 {
+		printWarn("Server did not stop and its pid is unknown")
+		<-exited
+		return
+	}
+	printWarn(fmt.Sprintf("Server did not stop within %v, sending SIGTERM", opts.timeout))
+	syscall.Kill(pid, syscall.SIGTERM)
+	if waitExit(exited, opts.killTimeout) {
+		return
+	}
+	printWarn(fmt.Sprintf("Server did not exit within %v, sending SIGKILL", opts.killTimeout))
+	syscall.Kill(pid, syscall.SIGKILL)
+	<-exited
+}
+
+// stopMarker tells a supervising daemon that the coming exit was requested and must not be restarted
+func stopMarker(profile string) string {
+	return profile + ".stopping"
+}
+
+// restartMarker tells a supervising daemon to start the server again right away, whatever its policy
+func restartMarker(profile string) string {
+	return profile + ".restarting"
+}
+
+func stopServer(profile string, opts stopOptions) {
+	var bus bus
+	bus.init(profile)
+	defer bus.close()
+	if _, err := bus.ping(); err != nil {
+		panic(fmt.Errorf("server is not running: %v", err))
+	}
+	opts.marker = stopMarker(profile)
+	shutdownServer(bus, opts)
+	printInfo("Server stopped.")
+}
+
+// shutdownServer brings down the server answering on b, wherever it was started from
+func shutdownServer(b bus, opts stopOptions) {
+	switch opts.announce {
+	case "say", "title":
+	default:
+		panic(fmt.Errorf("unknown announce method: %s", opts.announce))
+	}
+	pid, err := b.pid()
+	if err != nil {
+		printWarn(fmt.Sprintf("Cannot find the server process, SIGTERM/SIGKILL are unavailable: %v", err))
+		pid = 0
+	} else if err = syscall.Kill(pid, 0); err != nil {
+		printWarn(fmt.Sprintf("Cannot signal the server process %d, SIGTERM/SIGKILL are unavailable: %v", pid, err))
+		pid = 0
+	}
+	if opts.delay > 0 {
+		printInfo(fmt.Sprintf("Stopping in %v", opts.delay))
+	}
+	var exited <-chan struct{}
+	if pid > 0 {
+		exited = watchPid(pid)
+	} else {
+		// without a pid, the server is gone once it stops answering pings
+		ch := make(chan struct{})
+		go func() {
+			for {
+				if _, err := b.ping(); err != nil {
+					close(ch)
+					return
+				}
+				time.Sleep(500 * time.Millisecond)
+			}
+		}()
+		exited = ch
+	}
+	gracefulStop(b, pid, opts, exited)
+}
@@ -0,0 +1,54 @@
+//go:build ignore
+// +build ignore
+
+// gen writes archives that unpack must refuse, run it with `go run gen.go` inside this directory.
+// Every archive also carries a harmless entry, so a successful extraction is easy to spot.
+package main
+
+import (
+	"archive/zip"
+	"os"
+)
+
+type entry struct {
+	name string
+	mode os.FileMode
+	body string
+}
+
+var corpus = map[string][]entry{
+	"dotdot.zip":         {{"assets/../../evil.json", 0644, "evil"}},
+	"dotdot-only.zip":    {{"../evil.json", 0644, "evil"}},
+	"absolute.zip":       {{"/tmp/evil.json", 0644, "evil"}},
+	"backslash.zip":      {{"assets\\..\\..\\evil.json", 0644, "evil"}},
+	"drive.zip":          {{"C:/evil.json", 0644, "evil"}},
+	"symlink.zip":        {{"assets/link", os.ModeSymlink | 0777, "/etc"}, {"assets/link/passwd", 0644, "evil"}},
+	"device.zip":         {{"assets/null", os.ModeDevice | os.ModeCharDevice | 0666, ""}},
+	"fifo.zip":           {{"assets/fifo", os.ModeNamedPipe | 0666, ""}},
+	"fake-dir.zip":       {{"assets/dir", os.ModeDir | 0755, ""}},
+	"setuid-mode.zip":    {{"assets/suid", os.ModeSetuid | 0777, "normalized to 0755, not refused"}},
+	"world-writable.zip": {{"assets/open.json", 0666, "normalized to 0644, not refused"}},
+}
+
+func main() {
+	for name, entries := range corpus {
+		out, err := os.Create(name)
+		if err != nil {
+			panic(err)
+		}
+		w := zip.NewWriter(out)
+		for _, e := range append([]entry{{"assets/ok.json", 0644, "{}"}}, entries...) {
+			hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			hdr.SetMode(e.mode)
+			f, err := w.CreateHeader(hdr)
+			if err != nil {
+				panic(err)
+			}
+			f.Write([]byte(e.body))
+		}
+		if err = w.Close(); err != nil {
+			panic(err)
+		}
+		out.Close()
+	}
+}
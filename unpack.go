@@ -1,83 +1,331 @@
 package main
 
 import (
-	"archive/zip"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-	"time"
-
-	"gopkg.in/cheggaaa/pb.v1"
+	"sync"
 )
 
-func unpack(base string, file string) {
-	r, err := zip.OpenReader(file)
+// manifestEntry is taken from the zip central directory, so comparing it needs no extraction
+type manifestEntry struct {
+	Size  uint64 `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+type unpackManifest struct {
+	Source string                   `json:"source"`
+	Files  map[string]manifestEntry `json:"files"`
+}
+
+// manifestPath keeps the manifest next to the (resolved) target, so every core version gets its own
+func manifestPath(base string) string {
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		base = resolved
+	}
+	return filepath.Clean(base) + ".manifest"
+}
+
+func loadManifest(file string) unpackManifest {
+	manifest := unpackManifest{Files: map[string]manifestEntry{}}
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		panic(err)
+		return manifest
+	}
+	if err = json.Unmarshal(data, &manifest); err != nil || manifest.Files == nil {
+		printWarn(fmt.Sprintf("Ignoring broken manifest %s", file))
+		return unpackManifest{Files: map[string]manifestEntry{}}
+	}
+	return manifest
+}
+
+func (m unpackManifest) save(file string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// pendingEntry is recorded for files being rewritten, no size and checksum an archive entry has can match it
+var pendingEntry = manifestEntry{Size: ^uint64(0), CRC32: ^uint32(0)}
+
+// pending returns a copy of the manifest where the given targets are marked as pending,
+// they stay listed so the next run still prunes them if its apk no longer ships them
+func (m unpackManifest) pending(targets map[string]bool) unpackManifest {
+	result := unpackManifest{Source: m.Source, Files: map[string]manifestEntry{}}
+	for target, entry := range m.Files {
+		result.Files[target] = entry
+	}
+	for target := range targets {
+		result.Files[target] = pendingEntry
+	}
+	return result
+}
+
+type unpackOptions struct {
+	rules  *unpackRules
+	jobs   int
+	dryRun bool
+}
+
+// unpackPlan is what a run will do to the target
+type unpackPlan struct {
+	manifest  unpackManifest
+	extract   []apkEntry
+	added     map[string]bool
+	stale     []string
+	unchanged int
+}
+
+func planUnpack(base string, entries []apkEntry, old unpackManifest, sources string) unpackPlan {
+	plan := unpackPlan{
+		manifest: unpackManifest{Source: sources, Files: map[string]manifestEntry{}},
+		added:    map[string]bool{},
 	}
-	defer r.Close()
+	for _, e := range entries {
+		entry := manifestEntry{Size: e.file.UncompressedSize64, CRC32: e.file.CRC32}
+		plan.manifest.Files[e.target] = entry
+		prev, known := old.Files[e.target]
+		if known && prev == entry {
+			if info, err := os.Stat(filepath.Join(base, e.target)); err == nil && uint64(info.Size()) == entry.Size {
+				plan.unchanged++
+				continue
+			}
+		}
+		plan.added[e.target] = !known
+		plan.extract = append(plan.extract, e)
+	}
+	plan.stale = staleEntries(old, plan.manifest)
+	return plan
+}
+
+func (plan unpackPlan) counts() (added, updated int) {
+	for _, isNew := range plan.added {
+		if isNew {
+			added++
+		} else {
+			updated++
+		}
+	}
+	return
+}
+
+func unpack(base string, files []string, opts unpackOptions) {
+	bundle := openBundle(files)
+	defer bundle.close()
+	checkAPK(bundle.info())
+	// refuse the whole bundle before touching the target if any entry is unsafe or conflicting
+	entries, skip := bundle.entries(base, opts.rules)
+	mpath := manifestPath(base)
+	old := loadManifest(mpath)
+	plan := planUnpack(base, entries, old, bundle.sourceNames())
+	if opts.dryRun {
+		plan.print(old)
+		return
+	}
+	reportStart("unpack", map[string]interface{}{"target": base, "sources": bundle.sourceNames(),
+		"extract": len(plan.extract), "remove": len(plan.stale), "unchanged": plan.unchanged})
 	os.MkdirAll(base, 0755)
-	count := 0
-	skip := 0
-	for _, f := range r.File {
-		targetName := f.Name
-		if targetName == "lib/x86/libfmod.so" ||
-			strings.HasPrefix(targetName, "res/") ||
-			strings.HasPrefix(targetName, "org/") ||
-			strings.HasPrefix(targetName, "assets/shaders/") ||
-			strings.HasPrefix(targetName, "assets/skin_packs/") ||
-			strings.HasPrefix(targetName, "assets/renderer/") ||
-			strings.HasPrefix(targetName, "assets/animation/") ||
-			strings.HasPrefix(targetName, "META-INF/") ||
-			strings.HasSuffix(targetName, ".png") ||
-			strings.HasSuffix(targetName, ".fsb") ||
-			strings.HasSuffix(targetName, ".ttf") ||
-			strings.HasSuffix(targetName, ".jpg") ||
-			strings.HasSuffix(targetName, ".txt") ||
-			strings.HasSuffix(targetName, ".tga") ||
-			!strings.ContainsRune(targetName, '/') {
-			skip++
-			continue
+	// a run that dies halfway must not leave a manifest claiming the files it rewrites are up to date,
+	// the rest of the old manifest still holds and spares the next run from extracting them again
+	if err := old.pending(plan.added).save(mpath); err != nil {
+		panic(withCode("extract_failed", err))
+	}
+	extractAll(base, plan.extract, plan.added, opts.jobs)
+	removed := pruneStale(base, plan.stale)
+	if err := plan.manifest.save(mpath); err != nil {
+		panic(withCode("extract_failed", err))
+	}
+	added, updated := plan.counts()
+	printPair("Skipped", fmt.Sprint(skip))
+	printPair("Added", fmt.Sprint(added))
+	printPair("Updated", fmt.Sprint(updated))
+	printPair("Removed", fmt.Sprint(removed))
+	printPair("Unchanged", fmt.Sprint(plan.unchanged))
+	reportDone("unpack", map[string]int{"skipped": skip, "added": added, "updated": updated,
+		"removed": removed, "unchanged": plan.unchanged})
+}
+
+// extractAll runs jobs workers over the entries, reporting progress on one bar of the total size
+func extractAll(base string, entries []apkEntry, added map[string]bool, jobs int) {
+	if len(entries) == 0 {
+		return
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	var total int64
+	for _, e := range entries {
+		total += int64(e.file.UncompressedSize64)
+	}
+	bar := newProgress("unpack", 0, total)
+	queue := make(chan apkEntry)
+	errs := make(chan error, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range queue {
+				if err := extractEntry(base, e, bar); err != nil {
+					errs <- fmt.Errorf("%s: %v", e.target, err)
+					// drain the queue so the producer does not block
+					for range queue {
+					}
+					return
+				}
+				action := "update"
+				if added[e.target] {
+					action = "add"
+				}
+				reportFile(e.target, action, e.file.UncompressedSize64)
+			}
+		}()
+	}
+	go func() {
+		for _, e := range entries {
+			queue <- e
+		}
+		close(queue)
+	}()
+	wg.Wait()
+	bar.Finish()
+	select {
+	case err := <-errs:
+		panic(withCode("extract_failed", err))
+	default:
+	}
+}
+
+func extractEntry(base string, e apkEntry, progress io.Writer) error {
+	path, err := archiveTarget(base, e.target)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = checkInside(base, path); err != nil {
+		return err
+	}
+	os.Remove(path) // never write through whatever was there before
+	target, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, entryMode(e.file))
+	if err != nil {
+		return err
+	}
+	rc, err := e.file.Open()
+	if err != nil {
+		target.Close()
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(target, progress), rc)
+	rc.Close()
+	if cerr := target.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func formatSize(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// print lists what a run would do, with totals per top-level directory
+func (plan unpackPlan) print(old unpackManifest) {
+	type total struct {
+		files int
+		size  uint64
+	}
+	totals := map[string]*total{}
+	var dirs []string
+	count := func(name string, size uint64) {
+		dir := strings.SplitN(name, "/", 2)[0]
+		if totals[dir] == nil {
+			totals[dir] = &total{}
+			dirs = append(dirs, dir)
 		}
-		if targetName == "lib/x86/libminecraftpe.so" {
-			targetName = "libs/libminecraftpe.so"
+		totals[dir].files++
+		totals[dir].size += size
+	}
+	line := func(action, name string, size uint64) {
+		if output == outputJSON {
+			emit(event{Event: "plan", Path: name, Action: action, Size: size})
+			return
 		}
-		count++
-		fmt.Printf("\033[0;92m[%4d|%4d skiped]extracting: %s\033[0;31m", count, skip, targetName)
-		err = os.MkdirAll(filepath.Dir(filepath.Join(base, targetName)), 0755)
-		if err != nil {
-			panic(err)
+		fmt.Printf("%-7s %10s  %s\n", action, formatSize(size), name)
+	}
+	for _, e := range plan.extract {
+		action := "update"
+		if plan.added[e.target] {
+			action = "add"
 		}
-		target, err := os.OpenFile(filepath.Join(base, targetName), os.O_CREATE|os.O_RDWR, os.FileMode(f.Mode()))
-		if err != nil {
-			panic(err)
+		line(action, e.target, e.file.UncompressedSize64)
+		count(e.target, e.file.UncompressedSize64)
+	}
+	for _, name := range plan.stale {
+		line("remove", name, old.Files[name].Size)
+	}
+	sort.Strings(dirs)
+	var all total
+	for _, dir := range dirs {
+		printPair(dir+"/", fmt.Sprintf("%d files, %s", totals[dir].files, formatSize(totals[dir].size)))
+		all.files += totals[dir].files
+		all.size += totals[dir].size
+	}
+	printPair("Total", fmt.Sprintf("%d files, %s to extract, %d to remove, %d unchanged",
+		all.files, formatSize(all.size), len(plan.stale), plan.unchanged))
+}
+
+func staleEntries(old, current unpackManifest) []string {
+	var stale []string
+	for name := range old.Files {
+		if _, ok := current.Files[name]; !ok {
+			stale = append(stale, name)
 		}
-		rc, err := f.Open()
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// pruneStale deletes files of the old manifest that the new apk no longer ships, and the directories they leave empty
+func pruneStale(base string, stale []string) int {
+	removed := 0
+	for _, name := range stale {
+		path, err := archiveTarget(base, name)
 		if err != nil {
-			panic(err)
+			printWarn(fmt.Sprintf("Not removing %v", err))
+			continue
 		}
-		defer rc.Close()
-		time.Sleep(time.Millisecond) // Avoid some glitch about terminal
-		if f.UncompressedSize >= 1024000 {
-			fmt.Println()
-			bar := pb.StartNew(int(f.UncompressedSize))
-			bar.SetUnits(pb.U_BYTES_DEC)
-			bar.SetRefreshRate(time.Millisecond * 20)
-			bar.Start()
-			_, err := io.Copy(target, bar.NewProxyReader(rc))
-			if err != nil {
-				panic(err)
-			}
-			bar.Finish()
-		} else {
-			fmt.Print("\033[1K\r")
-			_, err := io.Copy(target, rc)
-			if err != nil {
-				panic(err)
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			printWarn(fmt.Sprintf("Failed to remove %s: %v", name, err))
+			continue
+		}
+		removed++
+		reportFile(name, "remove", 0)
+		for dir := filepath.Dir(path); dir != filepath.Clean(base); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
 			}
 		}
 	}
-	fmt.Print("\033[0m")
+	return removed
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// hostileEntries are the entries of the corpus in testdata/unpack that unpack has to refuse
+var hostileEntries = map[string]string{
+	"dotdot.zip":      "assets/../../evil.json",
+	"dotdot-only.zip": "../evil.json",
+	"absolute.zip":    "/tmp/evil.json",
+	"backslash.zip":   "assets\\..\\..\\evil.json",
+	"drive.zip":       "C:/evil.json",
+	"symlink.zip":     "assets/link",
+	"device.zip":      "assets/null",
+	"fifo.zip":        "assets/fifo",
+	"fake-dir.zip":    "assets/dir",
+}
+
+// benignModes are the modes the other archives come out with, whatever the archive asks for
+var benignModes = map[string]map[string]os.FileMode{
+	"setuid-mode.zip":    {"assets/ok.json": 0644, "assets/suid": 0755},
+	"world-writable.zip": {"assets/ok.json": 0644, "assets/open.json": 0644},
+}
+
+// unpackTestArchive runs file through the checks and the extraction of unpack, as the only apk of a bundle,
+// and returns the code of the error it stops with
+func unpackTestArchive(t *testing.T, file, base string) (code string, err interface{}) {
+	r, zerr := zip.OpenReader(file)
+	if zerr != nil {
+		t.Fatal(zerr)
+	}
+	defer r.Close()
+	defer func() {
+		if err = recover(); err != nil {
+			code = errorCode(err)
+		}
+	}()
+	bundle := &apkBundle{sources: []*apkSource{{name: filepath.Base(file), reader: &r.Reader}}}
+	entries, _ := bundle.entries(base, loadRules(""))
+	added := map[string]bool{}
+	for _, e := range entries {
+		added[e.target] = true
+	}
+	extractAll(base, entries, added, 1)
+	return "", nil
+}
+
+// umask reads the umask of the process without changing it, as other tests may be creating files
+func umask(t *testing.T) os.FileMode {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip("no /proc/self/status to read the umask from")
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Umask:") {
+			mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "Umask:")), 8, 32)
+			if err == nil {
+				return os.FileMode(mask)
+			}
+		}
+	}
+	t.Skip("no umask in /proc/self/status")
+	return 0
+}
+
+func TestUnpackCorpus(t *testing.T) {
+	archives, err := filepath.Glob(filepath.Join("testdata", "unpack", "*.zip"))
+	if err != nil || len(archives) == 0 {
+		t.Fatalf("no corpus in testdata/unpack (%v)", err)
+	}
+	mask := umask(t)
+	for _, archive := range archives {
+		name := filepath.Base(archive)
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			base := filepath.Join(root, "data")
+			os.Mkdir(base, 0755)
+			code, err := unpackTestArchive(t, archive, base)
+
+			if _, err := os.Lstat(filepath.Join(root, "evil.json")); err == nil {
+				t.Errorf("%s wrote outside of the target", name)
+			}
+			if entry, hostile := hostileEntries[name]; hostile {
+				if code != "unsafe_entry" {
+					t.Fatalf("got %v (%s), want an unsafe_entry error", err, code)
+				}
+				if !strings.Contains(fmt.Sprint(err), strconv.Quote(entry)) {
+					t.Errorf("refused with %q, want it to name %q", err, entry)
+				}
+				// the whole archive is refused before anything is written
+				if files, _ := ioutil.ReadDir(base); len(files) > 0 {
+					t.Errorf("extracted %d files from a refused archive", len(files))
+				}
+				return
+			}
+			modes, ok := benignModes[name]
+			if !ok {
+				t.Fatalf("%s is not described by the test, add it to hostileEntries or benignModes", name)
+			}
+			if err != nil {
+				t.Fatalf("refused a harmless archive: %v", err)
+			}
+			for target, want := range modes {
+				info, err := os.Lstat(filepath.Join(base, filepath.FromSlash(target)))
+				if err != nil {
+					t.Errorf("%s: %v", target, err)
+					continue
+				}
+				// entryMode decides the modes, the umask can only take bits away
+				if want &^= mask; info.Mode() != want {
+					t.Errorf("%s: mode %v, want %v", target, info.Mode(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingManifest(t *testing.T) {
+	base := t.TempDir()
+	ioutil.WriteFile(filepath.Join(base, "kept.json"), []byte("{}"), 0644)
+	old := unpackManifest{Files: map[string]manifestEntry{
+		"kept.json":    {Size: 2, CRC32: 1},
+		"dropped.json": {Size: 2, CRC32: 2},
+	}}
+	// the run that wrote this was interrupted while rewriting both files
+	interim := old.pending(map[string]bool{"kept.json": false, "dropped.json": false})
+	if len(interim.Files) != 2 {
+		t.Fatalf("interim manifest lists %d files, want both", len(interim.Files))
+	}
+
+	// the next apk still ships kept.json unchanged, and no longer ships dropped.json
+	entry := apkEntry{file: &zip.File{FileHeader: zip.FileHeader{UncompressedSize64: 2, CRC32: 1}}, target: "kept.json"}
+	plan := planUnpack(base, []apkEntry{entry}, interim, "next.apk")
+	if len(plan.extract) != 1 || plan.unchanged != 0 {
+		t.Errorf("extracts %d and skips %d, the half written file must be extracted again", len(plan.extract), plan.unchanged)
+	}
+	if len(plan.stale) != 1 || plan.stale[0] != "dropped.json" {
+		t.Errorf("prunes %v, want [dropped.json]", plan.stale)
+	}
+}
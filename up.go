@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// upEntry is one [[server]] table of the up config, a profile with the daemon flags it runs with
+type upEntry struct {
+	Profile     string   `toml:"profile"`
+	Restart     string   `toml:"restart"`
+	Backoff     duration `toml:"backoff"`
+	MaxBackoff  duration `toml:"max_backoff"`
+	CrashLimit  *int     `toml:"crash_limit"`
+	CrashWindow duration `toml:"crash_window"`
+	Alert       string   `toml:"alert"`
+	Watchdog    duration `toml:"watchdog_interval"`
+	// Wait holds back the next profiles until this one answers a ping, for at most this long
+	Wait duration `toml:"wait"`
+}
+
+type upConfig struct {
+	Server []upEntry `toml:"server"`
+}
+
+func (entry *upEntry) check() error {
+	if len(entry.Profile) == 0 {
+		return errors.New("profile is required")
+	}
+	if strings.ContainsAny(entry.Profile, "/\x00") {
+		return fmt.Errorf("bad profile name %q", entry.Profile)
+	}
+	switch entry.Restart {
+	case "":
+		entry.Restart = "on-failure"
+	case "always", "on-failure", "never":
+	default:
+		return fmt.Errorf("unknown restart policy %q", entry.Restart)
+	}
+	if entry.Backoff.Duration <= 0 {
+		entry.Backoff.Duration = time.Second
+	}
+	if entry.MaxBackoff.Duration <= 0 {
+		entry.MaxBackoff.Duration = time.Minute
+	}
+	if entry.CrashWindow.Duration <= 0 {
+		entry.CrashWindow.Duration = 10 * time.Minute
+	}
+	if entry.CrashLimit == nil {
+		limit := 5
+		entry.CrashLimit = &limit
+	}
+	return nil
+}
+
+func (entry *upEntry) policy() restartPolicy {
+	return restartPolicy{mode: entry.Restart, backoff: entry.Backoff.Duration, maxBackoff: entry.MaxBackoff.Duration,
+		crashLimit: *entry.CrashLimit, crashWindow: entry.CrashWindow.Duration, alert: entry.Alert}
+}
+
+func loadUpConfig(file string) (*upConfig, error) {
+	config := &upConfig{}
+	meta, err := toml.DecodeFile(file, config)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		printWarn(fmt.Sprintf("%s: ignoring unknown keys %v", file, undecoded))
+	}
+	seen := map[string]bool{}
+	for i := range config.Server {
+		entry := &config.Server[i]
+		if err := entry.check(); err != nil {
+			return nil, fmt.Errorf("server %q: %v", entry.Profile, err)
+		}
+		if seen[entry.Profile] {
+			return nil, fmt.Errorf("server %q is listed twice", entry.Profile)
+		}
+		seen[entry.Profile] = true
+	}
+	return config, nil
+}
+
+// upLockName is the name of the pid file and log of the up process that owns the config
+func upLockName(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file))
+}
+
+// upServer is a profile supervised by up, with the daemon of its own running in a goroutine
+type upServer struct {
+	entry   upEntry
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+func startUpServer(entry upEntry, file string) *upServer {
+	s := &upServer{entry: entry, signals: make(chan os.Signal, 1), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer func() {
+			if r := recover(); r != nil {
+				printWarn(fmt.Sprintf("%s: %v", entry.Profile, r))
+			}
+		}()
+		lock, err := lockProfile(entry.Profile, file)
+		if err != nil {
+			panic(err)
+		}
+		defer unlockProfile(lock)
+		config := loadProfileConfig(entry.Profile)
+		sched := startScheduler(entry.Profile, config)
+		defer sched.stop()
+		wd := watchdogOptions{interval: entry.Watchdog.Duration, timeout: 5 * time.Second, misses: 3, grace: 2 * time.Minute}
+		exit := runDaemon(entry.Profile, config, entry.policy(), wd, newNotifier(false), s.signals)
+		printPair(entry.Profile, fmt.Sprintf("%s after %v%s", exit, exit.runtime(), restartNote(exit)))
+	}()
+	return s
+}
+
+// waitReady gives the server entry.Wait to answer a ping before the next profile starts
+func (s *upServer) waitReady() {
+	if s.entry.Wait.Duration <= 0 {
+		return
+	}
+	deadline := time.Now().Add(s.entry.Wait.Duration)
+	for time.Now().Before(deadline) {
+		if _, err := serverPid(s.entry.Profile); err == nil {
+			printPair(s.entry.Profile, "ready")
+			return
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+	printWarn(fmt.Sprintf("%s did not answer within %v, starting the next profiles anyway", s.entry.Profile, s.entry.Wait))
+}
+
+func (s *upServer) stop() {
+	select {
+	case s.signals <- syscall.SIGTERM:
+	case <-s.done:
+	}
+	<-s.done
+}
+
+// runUp starts the profiles of the config in order and supervises them until told to stop;
+// SIGHUP reads the config again and only starts, stops or restarts the profiles that changed
+func runUp(file string) {
+	config, err := loadUpConfig(file)
+	if err != nil {
+		panic(fmt.Errorf("%s: %v", file, err))
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	n := newNotifier(true)
+
+	var order []string
+	servers := map[string]*upServer{}
+	start := func(entries []upEntry) {
+		for _, entry := range entries {
+			printPair(entry.Profile, "starting")
+			servers[entry.Profile] = startUpServer(entry, file)
+			order = append(order, entry.Profile)
+			servers[entry.Profile].waitReady()
+		}
+	}
+	stop := func(profiles []string) {
+		// in reverse order of startup, so what others wait for goes last
+		for i := len(order) - 1; i >= 0; i-- {
+			for _, profile := range profiles {
+				if order[i] == profile {
+					printPair(profile, "stopping")
+					servers[profile].stop()
+					delete(servers, profile)
+					order = append(order[:i], order[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	start(config.Server)
+	n.send(daemon.SdNotifyReady)
+
+	for {
+		var running []string
+		for _, profile := range order {
+			select {
+			case <-servers[profile].done:
+			default:
+				running = append(running, profile)
+			}
+		}
+		if len(running) == 0 {
+			printInfo("No profile is running any more.")
+			return
+		}
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				n.send(daemon.SdNotifyStopping)
+				stop(append([]string{}, order...))
+				return
+			}
+			n.send(daemon.SdNotifyReloading)
+			reloaded, err := loadUpConfig(file)
+			if err != nil {
+				printWarn(fmt.Sprintf("Keeping the running profiles, %s: %v", file, err))
+				n.send(daemon.SdNotifyReady)
+				continue
+			}
+			var added []upEntry
+			var removed []string
+			wanted := map[string]bool{}
+			for _, entry := range reloaded.Server {
+				wanted[entry.Profile] = true
+				current, ok := servers[entry.Profile]
+				switch {
+				case !ok:
+					added = append(added, entry)
+				case !reflect.DeepEqual(current.entry, entry):
+					printPair(entry.Profile, "changed, restarting")
+					removed = append(removed, entry.Profile)
+					added = append(added, entry)
+				default:
+					// a profile that stopped for good is started again by a reload
+					select {
+					case <-current.done:
+						removed = append(removed, entry.Profile)
+						added = append(added, entry)
+					default:
+					}
+				}
+			}
+			for _, profile := range order {
+				if !wanted[profile] {
+					removed = append(removed, profile)
+				}
+			}
+			stop(removed)
+			start(added)
+			printInfo(fmt.Sprintf("Reloaded %s: %d started, %d stopped, %d untouched.", file, len(added), len(removed), len(order)-len(added)))
+			n.send(daemon.SdNotifyReady)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// signalUp sends sig to the up process of the config and waits up to wait for it to go away
+func signalUp(file string, sig syscall.Signal, wait time.Duration) {
+	pid := lockedPid(upLockName(file))
+	if pid <= 0 {
+		panic(fmt.Errorf("nothing is running %s", file))
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		panic(err)
+	}
+	printPair("Signaled", fmt.Sprintf("pid %d with %v", pid, sig))
+	if wait <= 0 {
+		return
+	}
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		if lockedPid(upLockName(file)) == 0 {
+			printInfo("Stopped.")
+			return
+		}
+	}
+	panic(fmt.Errorf("pid %d is still running after %v", pid, wait))
+}
+
+// printUpStatus shows every profile of the config on one line each
+func printUpStatus(file string) bool {
+	config, err := loadUpConfig(file)
+	if err != nil {
+		panic(fmt.Errorf("%s: %v", file, err))
+	}
+	up := lockedPid(upLockName(file))
+	if up > 0 {
+		printPair("Supervisor", fmt.Sprintf("running, pid %d", up))
+	} else {
+		printPair("Supervisor", "not running")
+	}
+	for _, entry := range config.Server {
+		state := "stopped"
+		if pid := lockedPid(entry.Profile); pid > 0 {
+			state = fmt.Sprintf("supervised by pid %d", pid)
+		}
+		if pid, err := serverPid(entry.Profile); err == nil {
+			state += fmt.Sprintf(", server pid %d answering", pid)
+		} else {
+			state += ", server not answering"
+		}
+		if last, ok := lastExit(entry.Profile); ok {
+			state += fmt.Sprintf(", last %s %s", last.End.Format("2006-01-02 15:04"), last)
+		}
+		printPair(entry.Profile, state)
+	}
+	return up > 0
+}
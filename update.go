@@ -1,60 +1,449 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
-	"gopkg.in/cheggaaa/pb.v1"
+	"github.com/valyala/fasttemplate"
 )
 
+const defaultReleaseEndpoint = "https://api.github.com/repos/codehz/mcpeserver/releases"
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	URL  string `json:"browser_download_url"`
+}
+
 type releaseInfo struct {
-	Assets []struct {
-		URL string `json:"browser_download_url"`
-	} `json:"assets"`
+	TagName    string         `json:"tag_name"`
+	Draft      bool           `json:"draft"`
+	Prerelease bool           `json:"prerelease"`
+	Assets     []releaseAsset `json:"assets"`
 }
 
-func getServerURL() string {
-	resp, err := http.Get("https://api.github.com/repos/codehz/mcpeserver/releases/latest")
+func getReleases(endpoint string) []releaseInfo {
+	resp, err := http.Get(endpoint)
 	if err != nil {
-		panic(err)
+		panic(withCode("release_lookup", err))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		panic(withCode("release_lookup", fmt.Errorf("%s: %s", endpoint, resp.Status)))
+	}
 	contents, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		panic(withCode("release_lookup", err))
 	}
-	info := releaseInfo{}
-	if err = json.Unmarshal(contents, &info); err != nil {
-		panic(err)
+	infos := []releaseInfo{}
+	if err = json.Unmarshal(contents, &infos); err != nil {
+		// endpoint may point to a single release (e.g. .../releases/latest)
+		info := releaseInfo{}
+		if err2 := json.Unmarshal(contents, &info); err2 != nil {
+			panic(withCode("release_lookup", err))
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// getRelease picks the newest release of the channel: "stable" skips prereleases, "beta" accepts them
+func getRelease(endpoint, channel string) releaseInfo {
+	for _, info := range getReleases(endpoint) {
+		if info.Draft {
+			continue
+		}
+		switch channel {
+		case "stable":
+			if info.Prerelease {
+				continue
+			}
+		case "beta":
+		default:
+			panic(fmt.Errorf("unknown channel: %s", channel))
+		}
+		return info
+	}
+	panic(withCode("release_lookup", fmt.Errorf("no release found in channel %s", channel)))
+}
+
+// matchAsset returns the asset whose name matches the pattern ({{os}} and {{arch}} are expanded),
+// preferring the one that mentions our arch when several match
+func (info releaseInfo) matchAsset(pattern string) (releaseAsset, bool) {
+	pattern = fasttemplate.New(pattern, "{{", "}}").ExecuteString(map[string]interface{}{
+		"os":   runtime.GOOS,
+		"arch": runtime.GOARCH,
+	})
+	var matches []releaseAsset
+	for _, asset := range info.Assets {
+		matched, err := path.Match(pattern, asset.Name)
+		if err != nil {
+			panic(err)
+		}
+		if matched {
+			matches = append(matches, asset)
+		}
+	}
+	if len(matches) == 0 {
+		return releaseAsset{}, false
+	}
+	for _, asset := range matches {
+		if strings.Contains(asset.Name, runtime.GOARCH) {
+			return asset, true
+		}
+	}
+	return matches[0], true
+}
+
+func (info releaseInfo) findAsset(pattern string) releaseAsset {
+	asset, ok := info.matchAsset(pattern)
+	if !ok {
+		panic(withCode("asset_not_found", fmt.Errorf("no asset matching %q in release %s", pattern, info.TagName)))
+	}
+	return asset
+}
+
+func parseVersion(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if idx := strings.IndexAny(version, "-+"); idx >= 0 {
+		version = version[:idx]
+	}
+	parts := strings.Split(version, ".")
+	result := make([]int, len(parts))
+	for i, part := range parts {
+		result[i], _ = strconv.Atoi(part)
+	}
+	return result
+}
+
+// compareVersion returns -1, 0 or 1 like strings.Compare, but per numeric component
+func compareVersion(a, b string) int {
+	va, vb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
 	}
-	return info.Assets[0].URL
+	return 0
 }
 
-func fetchBinary(url string, target string) {
-	out, err := os.OpenFile(target+".tmp", os.O_CREATE|os.O_RDWR, 0755)
+func fetchSmall(url string) []byte {
+	resp, err := http.Get(url)
+	if err != nil {
+		panic(withCode("download_failed", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		panic(withCode("download_failed", fmt.Errorf("%s: %s", url, resp.Status)))
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		panic(withCode("download_failed", err))
+	}
+	return contents
+}
+
+// releaseDigest looks up the expected digest of the asset in the release's checksums file,
+// verifying the checksums file against its detached signature when a public key is given
+func releaseDigest(info releaseInfo, asset releaseAsset, checksums, pubkey string, insecure bool) fileDigest {
+	digest := fileDigest{size: asset.Size}
+	sumsAsset, ok := info.matchAsset(checksums)
+	if !ok {
+		if insecure {
+			printWarn("No checksums found in release, skipping verification")
+			return digest
+		}
+		panic(withCode("checksum_missing", fmt.Errorf("no checksums asset matching %q in release %s (use -insecure to skip)", checksums, info.TagName)))
+	}
+	sums := fetchSmall(sumsAsset.URL)
+	if len(pubkey) > 0 {
+		pk, err := parsePublicKey(pubkey)
+		if err != nil {
+			panic(withCode("bad_public_key", err))
+		}
+		sigAsset, ok := info.matchAsset(sumsAsset.Name + ".minisig")
+		if !ok {
+			sigAsset, ok = info.matchAsset(sumsAsset.Name + ".sig")
+		}
+		if !ok {
+			panic(withCode("signature_missing", fmt.Errorf("no signature for %s in release %s", sumsAsset.Name, info.TagName)))
+		}
+		if err = pk.verifySignature(sums, fetchSmall(sigAsset.URL)); err != nil {
+			panic(withCode("signature_invalid", fmt.Errorf("%s: %v", sigAsset.Name, err)))
+		}
+		printPair("Signature", sigAsset.Name+" OK")
+	}
+	table, err := parseChecksums(sums)
+	if err != nil {
+		panic(withCode("checksum_missing", fmt.Errorf("%s: %v", sumsAsset.Name, err)))
+	}
+	sum, ok := table[asset.Name]
+	if !ok {
+		panic(withCode("checksum_missing", fmt.Errorf("%s has no entry for %s", sumsAsset.Name, asset.Name)))
+	}
+	digest.sha256 = sum
+	return digest
+}
+
+type updateOptions struct {
+	endpoint  string
+	channel   string
+	pattern   string
+	checksums string
+	pubkey    string
+	insecure  bool
+	retries   int
+	check     bool
+	rollback  bool
+}
+
+func update(opts updateOptions) {
+	exe, err := os.Executable()
 	if err != nil {
 		panic(err)
 	}
+	if opts.rollback {
+		rollback(exe)
+		reportDone("update", map[string]string{"rolledBack": exe})
+		return
+	}
+	info := getRelease(opts.endpoint, opts.channel)
+	printPair("Current Version", VERSION)
+	printPair("Latest Version", info.TagName)
+	if compareVersion(info.TagName, VERSION) <= 0 {
+		printInfo("Already up to date.")
+		reportDone("update", map[string]string{"current": VERSION, "latest": info.TagName})
+		return
+	}
+	asset := info.findAsset(opts.pattern)
+	printPair("Asset", asset.Name)
+	if opts.check {
+		printInfo("Update available.")
+		reportDone("update", map[string]string{"current": VERSION, "latest": info.TagName, "asset": asset.Name})
+		return
+	}
+	reportStart("update", map[string]interface{}{"current": VERSION, "latest": info.TagName, "asset": asset.Name, "size": asset.Size})
+	digest := releaseDigest(info, asset, opts.checksums, opts.pubkey, opts.insecure)
+	if err = keepPrevious(exe); err != nil {
+		panic(withCode("install_failed", fmt.Errorf("failed to keep previous binary: %v", err)))
+	}
+	if err = fetchBinary(asset.URL, exe, digest, opts.retries); err != nil {
+		panic(withCode("download_failed", err))
+	}
+	if err = smokeTest(exe, info.TagName); err != nil {
+		printWarn(fmt.Sprintf("Smoke test failed: %v", err))
+		if rerr := os.Rename(exe+".prev", exe); rerr != nil {
+			panic(withCode("rollback_failed", fmt.Errorf("rollback failed: %v", rerr)))
+		}
+		panic(withCode("smoke_test_failed", fmt.Errorf("update to %s rolled back: %v", info.TagName, err)))
+	}
+	printPair("Installed", info.TagName)
+	reportDone("update", map[string]string{"installed": info.TagName})
+}
+
+// keepPrevious saves the running binary as exe.prev so that a broken update can be undone
+func keepPrevious(exe string) error {
+	prev := exe + ".prev"
+	os.Remove(prev)
+	if os.Link(exe, prev) == nil {
+		return nil
+	}
+	in, err := os.Open(exe)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(prev, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// smokeTest runs the new binary's version subcommand and checks that it reports the expected version
+func smokeTest(exe, expected string) error {
+	cmd := exec.Command(exe, "version")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(output.String()))
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		return errors.New("version command timed out")
+	}
+	for _, line := range strings.Split(stripANSI(output.String()), "\n") {
+		if strings.HasPrefix(line, "Version: ") {
+			version := strings.TrimSpace(strings.TrimPrefix(line, "Version: "))
+			if compareVersion(version, expected) != 0 {
+				return fmt.Errorf("new binary reports version %s, expected %s", version, expected)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected version output: %q", output.String())
+}
+
+func rollback(exe string) {
+	prev := exe + ".prev"
+	if _, err := os.Stat(prev); err != nil {
+		panic(withCode("no_previous_binary", fmt.Errorf("no previous binary to roll back to: %v", err)))
+	}
+	if err := os.Rename(prev, exe); err != nil {
+		panic(withCode("rollback_failed", err))
+	}
+	printInfo("Rolled back to the previous binary.")
+}
+
+// fetchBinary downloads url next to target and only replaces target once the download matches want,
+// resuming a partial download left by an earlier attempt when the server still has the same file
+// fetchBackoff is the wait before the first retry of a download, doubled for each one after it
+var fetchBackoff = time.Second
+
+func fetchBinary(url string, target string, want fileDigest, retries int) error {
+	tmp := target + ".tmp"
+	backoff := fetchBackoff
+	for attempt := 0; ; attempt++ {
+		err := fetchPartial(url, tmp)
+		if err == nil {
+			break
+		}
+		if _, fatal := err.(fatalFetchError); fatal || attempt >= retries {
+			return err
+		}
+		printWarn(fmt.Sprintf("Download failed (%v), retrying in %v...", err, backoff))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+	os.Remove(tmp + ".etag")
+	if err := want.verify(tmp); err != nil {
+		os.Remove(tmp)
+		return withCode("checksum_mismatch", fmt.Errorf("refusing to install %s: %v", target, err))
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return withCode("install_failed", err)
+	}
+	printInfo("Update Finished.")
+	return nil
+}
+
+// fatalFetchError is returned for failures that retrying will not fix
+type fatalFetchError struct{ error }
+
+// fetchPartial continues the download into tmp, using the validator saved in tmp.etag to make sure
+// the bytes already on disk belong to the same file (If-Range); the server answers 200 when they do not
+func fetchPartial(url, tmp string) error {
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return fatalFetchError{err}
+	}
 	defer out.Close()
-	resp, err := http.Get(url)
+	offset, err := out.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic(err)
+		return fatalFetchError{err}
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fatalFetchError{err}
+	}
+	validator, _ := ioutil.ReadFile(tmp + ".etag")
+	if offset > 0 && len(validator) > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	} else {
+		offset = 0
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			os.Remove(tmp + ".etag")
+			out.Truncate(0)
+			return fmt.Errorf("unexpected Content-Range: %q", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is already complete (or bogus, which verification will catch)
+		var total int64
+		if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total); err == nil && total == offset {
+			return nil
+		}
+		os.Remove(tmp + ".etag")
+		out.Truncate(0)
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	default:
+		return fatalFetchError{fmt.Errorf("%s: %s", url, resp.Status)}
+	}
+	if err = out.Truncate(offset); err != nil {
+		return fatalFetchError{err}
+	}
+	if _, err = out.Seek(offset, io.SeekStart); err != nil {
+		return fatalFetchError{err}
+	}
+	// weak validators cannot be used with If-Range
+	if etag := resp.Header.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		ioutil.WriteFile(tmp+".etag", []byte(etag), 0644)
+	} else if modified := resp.Header.Get("Last-Modified"); len(modified) > 0 {
+		ioutil.WriteFile(tmp+".etag", []byte(modified), 0644)
+	} else {
+		os.Remove(tmp + ".etag")
+	}
 
-	bar := pb.StartNew(int(resp.ContentLength))
-	bar.SetUnits(pb.U_BYTES_DEC)
-	bar.SetRefreshRate(time.Millisecond * 20)
-	bar.Prefix("mcpeserver")
-	bar.Start()
-	_, err = io.Copy(out, bar.NewProxyReader(resp.Body))
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	bar := newProgress("mcpeserver", offset, total)
+	n, err := io.Copy(io.MultiWriter(out, bar), resp.Body)
+	bar.Finish()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("connection dropped after %d of %d bytes", offset+n, total)
 	}
-	bar.FinishPrint("\033[0;34mUpdate Finished.\033[0m")
-	os.Rename(target+".tmp", target)
+	return nil
 }
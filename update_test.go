@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testReleases = `[
+	{"tag_name": "v0.4.0", "draft": true, "prerelease": false},
+	{"tag_name": "v0.3.0-rc1", "draft": false, "prerelease": true},
+	{"tag_name": "v0.2.0", "draft": false, "prerelease": false}
+]`
+
+// releaseServer answers every request with body, or with status when it is not 200
+func releaseServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+// lookup runs getRelease and turns its panic into the error code
+func lookup(endpoint, channel string) (info releaseInfo, code string) {
+	defer func() {
+		if r := recover(); r != nil {
+			code = errorCode(r)
+		}
+	}()
+	return getRelease(endpoint, channel), ""
+}
+
+func TestGetRelease(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		channel string
+		tag     string
+		code    string
+	}{
+		{"stable skips drafts and prereleases", 200, testReleases, "stable", "v0.2.0", ""},
+		{"beta takes prereleases", 200, testReleases, "beta", "v0.3.0-rc1", ""},
+		{"single release object", 200, `{"tag_name": "v1.0.0"}`, "stable", "v1.0.0", ""},
+		{"nothing in channel", 200, `[{"tag_name": "v1.0.0-rc1", "prerelease": true}]`, "stable", "", "release_lookup"},
+		{"unknown channel", 200, testReleases, "nightly", "", "internal"},
+		{"not found", 404, `{"message": "Not Found"}`, "stable", "", "release_lookup"},
+		{"not json", 200, `<html>`, "stable", "", "release_lookup"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := releaseServer(test.status, test.body)
+			defer srv.Close()
+			info, code := lookup(srv.URL, test.channel)
+			if code != test.code {
+				t.Fatalf("error code %q, want %q", code, test.code)
+			}
+			if info.TagName != test.tag {
+				t.Errorf("got release %q, want %q", info.TagName, test.tag)
+			}
+		})
+	}
+}
+
+func TestMatchAsset(t *testing.T) {
+	info := releaseInfo{TagName: "v1.0.0", Assets: []releaseAsset{
+		{Name: "mcpeserver-linux-386"},
+		{Name: "mcpeserver-linux-" + runtime.GOARCH},
+		{Name: "mcpeserver-windows-amd64.exe"},
+		{Name: "SHA256SUMS"},
+	}}
+	tests := []struct {
+		pattern string
+		want    string
+		found   bool
+	}{
+		{"mcpeserver-{{os}}-{{arch}}", "mcpeserver-" + runtime.GOOS + "-" + runtime.GOARCH, runtime.GOOS == "linux"},
+		{"mcpeserver-linux-*", "mcpeserver-linux-" + runtime.GOARCH, true},
+		{"SHA256SUMS", "SHA256SUMS", true},
+		{"*.exe", "mcpeserver-windows-amd64.exe", true},
+		{"mcpeserver-darwin-*", "", false},
+	}
+	for _, test := range tests {
+		asset, found := info.matchAsset(test.pattern)
+		if found != test.found || asset.Name != test.want {
+			t.Errorf("%q: got %q (%v), want %q (%v)", test.pattern, asset.Name, found, test.want, test.found)
+		}
+	}
+}
+
+func TestFetchPartial(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	const etag = `"v1"`
+	tests := []struct {
+		name    string
+		partial []byte
+		saved   string
+		status  int
+		// rangeSent is whether the request must carry Range and If-Range
+		rangeSent bool
+		fatal     bool
+		failed    bool
+	}{
+		{"fresh download", nil, "", 0, false, false, false},
+		{"resume with matching validator", content[:1000], etag, 0, true, false, false},
+		{"validator changed", []byte("stale bytes"), `"v0"`, 0, true, false, false},
+		{"partial without validator", content[:1000], "", 0, false, false, false},
+		{"already complete", content, etag, 0, true, false, false},
+		{"not found is fatal", nil, "", 404, false, true, true},
+		{"forbidden is fatal", content[:1000], etag, 403, true, true, true},
+		{"server error is retried", nil, "", 503, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sentRange, sentIfRange string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sentRange, sentIfRange = r.Header.Get("Range"), r.Header.Get("If-Range")
+				if test.status != 0 {
+					http.Error(w, http.StatusText(test.status), test.status)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				http.ServeContent(w, r, "mcpeserver", time.Time{}, bytes.NewReader(content))
+			}))
+			defer srv.Close()
+			tmp := filepath.Join(t.TempDir(), "mcpeserver.tmp")
+			if test.partial != nil {
+				ioutil.WriteFile(tmp, test.partial, 0755)
+			}
+			if len(test.saved) > 0 {
+				ioutil.WriteFile(tmp+".etag", []byte(test.saved), 0644)
+			}
+
+			err := fetchPartial(srv.URL, tmp)
+			wantIfRange := ""
+			if test.rangeSent {
+				wantIfRange = test.saved
+			}
+			if (len(sentRange) > 0) != test.rangeSent || sentIfRange != wantIfRange {
+				t.Errorf("sent Range %q If-Range %q", sentRange, sentIfRange)
+			}
+			if _, fatal := err.(fatalFetchError); fatal != test.fatal {
+				t.Errorf("error %v, want fatal=%v", err, test.fatal)
+			}
+			if (err != nil) != test.failed {
+				t.Fatalf("error %v, want failed=%v", err, test.failed)
+			}
+			if test.failed {
+				return
+			}
+			if got, _ := ioutil.ReadFile(tmp); !bytes.Equal(got, content) {
+				t.Errorf("downloaded %d bytes that do not match the %d served", len(got), len(content))
+			}
+			if saved, _ := ioutil.ReadFile(tmp + ".etag"); string(saved) != etag {
+				t.Errorf("saved validator %q, want %q", saved, etag)
+			}
+		})
+	}
+}
+
+// droppingServer serves content under etag, but the first response dies after half of the body;
+// after that drop, content and etag are replaced by the next ones if given
+func droppingServer(t *testing.T, contents [][]byte, etags []string, requests *[]*http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		content, etag := contents[0], etags[0]
+		if len(*requests) > 1 {
+			content, etag = contents[len(contents)-1], etags[len(etags)-1]
+		}
+		w.Header().Set("ETag", etag)
+		if len(*requests) > 1 {
+			http.ServeContent(w, r, "mcpeserver", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:len(content)/2])
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+}
+
+func TestFetchBinaryRetries(t *testing.T) {
+	first := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	second := bytes.Repeat([]byte("fedcba9876543210"), 3000)
+	tests := []struct {
+		name     string
+		contents [][]byte
+		etags    []string
+	}{
+		{"resumes after a dropped connection", [][]byte{first}, []string{`"v1"`}},
+		// If-Range no longer matches, so the server sends the new file whole
+		{"starts over when the file changed", [][]byte{first, second}, []string{`"v1"`, `"v2"`}},
+	}
+	defer func(backoff time.Duration) { fetchBackoff = backoff }(fetchBackoff)
+	fetchBackoff = time.Millisecond
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests []*http.Request
+			srv := droppingServer(t, test.contents, test.etags, &requests)
+			defer srv.Close()
+			want := test.contents[len(test.contents)-1]
+			sum := sha256.Sum256(want)
+			target := filepath.Join(t.TempDir(), "mcpeserver")
+
+			if err := fetchBinary(srv.URL, target, fileDigest{size: int64(len(want)), sha256: sum[:]}, 2); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := ioutil.ReadFile(target); !bytes.Equal(got, want) {
+				t.Errorf("installed %d bytes that do not match the %d served", len(got), len(want))
+			}
+			if len(requests) != 2 {
+				t.Fatalf("made %d requests, want 2", len(requests))
+			}
+			retry := requests[1]
+			wantRange := fmt.Sprintf("bytes=%d-", len(first)/2)
+			if retry.Header.Get("Range") != wantRange || retry.Header.Get("If-Range") != test.etags[0] {
+				t.Errorf("retry sent Range %q If-Range %q, want %q and %q", retry.Header.Get("Range"),
+					retry.Header.Get("If-Range"), wantRange, test.etags[0])
+			}
+			if _, err := os.Stat(target + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("the partial download was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchBinaryFatal(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer srv.Close()
+	err := fetchBinary(srv.URL, filepath.Join(t.TempDir(), "mcpeserver"), fileDigest{}, 3)
+	if _, fatal := err.(fatalFetchError); !fatal {
+		t.Errorf("error %v, want a fatal one", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, a 4xx must not be retried", requests)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// fileDigest is what a downloaded file is expected to look like, zero fields are not checked
+type fileDigest struct {
+	size   int64
+	sha256 []byte
+}
+
+func (want fileDigest) verify(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if want.size > 0 && n != want.size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", want.size, n)
+	}
+	if want.sha256 != nil {
+		if sum := h.Sum(nil); !bytes.Equal(sum, want.sha256) {
+			return fmt.Errorf("sha256 mismatch: expected %x, got %x", want.sha256, sum)
+		}
+	}
+	return nil
+}
+
+// parseChecksums reads a sha256sum style file ("<hex>  <name>" or "<hex> *<name>")
+func parseChecksums(data []byte) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the name is everything after the first run of blanks, it may contain spaces itself
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed checksum line: %q", line)
+		}
+		name := strings.TrimPrefix(strings.TrimLeft(line[i:], " \t"), "*")
+		if len(name) == 0 {
+			return nil, fmt.Errorf("malformed checksum line: %q", line)
+		}
+		sum, err := hex.DecodeString(line[:i])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("malformed sha256: %q", line[:i])
+		}
+		result[name] = sum
+	}
+	return result, scanner.Err()
+}
+
+// lastLine returns the last line that is not a minisign comment
+func lastLine(data string) string {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "untrusted comment:") && !strings.HasPrefix(line, "trusted comment:") {
+			return line
+		}
+	}
+	return ""
+}
+
+type publicKey struct {
+	keyID []byte
+	key   ed25519.PublicKey
+}
+
+// parsePublicKey accepts a raw base64 ed25519 key, a minisign public key, or a file containing either
+func parsePublicKey(value string) (*publicKey, error) {
+	if data, err := ioutil.ReadFile(value); err == nil {
+		value = lastLine(string(data))
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	switch len(raw) {
+	case ed25519.PublicKeySize:
+		return &publicKey{key: raw}, nil
+	case 2 + 8 + ed25519.PublicKeySize:
+		if string(raw[:2]) != "Ed" {
+			return nil, fmt.Errorf("unsupported minisign key algorithm %q", raw[:2])
+		}
+		return &publicKey{keyID: raw[2:10], key: raw[10:]}, nil
+	}
+	return nil, fmt.Errorf("invalid public key length: %d", len(raw))
+}
+
+// verifySignature checks a detached signature over data, either raw ed25519 (binary or base64) or minisign
+func (pk *publicKey) verifySignature(data, sig []byte) error {
+	if len(sig) == ed25519.SignatureSize {
+		if !ed25519.Verify(pk.key, data, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	text := string(sig)
+	if !strings.HasPrefix(text, "untrusted comment:") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+		if err != nil || len(raw) != ed25519.SignatureSize {
+			return errors.New("malformed signature")
+		}
+		return pk.verifySignature(data, raw)
+	}
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("malformed minisign global signature")
+	}
+	if pk.keyID != nil && !bytes.Equal(pk.keyID, raw[2:10]) {
+		return fmt.Errorf("signature key id %X does not match public key %X", raw[2:10], pk.keyID)
+	}
+	message := data
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", raw[:2])
+	}
+	signature := raw[10:]
+	if !ed25519.Verify(pk.key, message, signature) {
+		return errors.New("signature verification failed")
+	}
+	trusted := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ed25519.Verify(pk.key, append(append([]byte{}, signature...), trusted...), global) {
+		return errors.New("trusted comment verification failed")
+	}
+	return nil
+}
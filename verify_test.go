@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksums(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		name  string
+		data  string
+		want  map[string]string
+		valid bool
+	}{
+		{"text mode", sum + "  mcpeserver-linux-amd64\n", map[string]string{"mcpeserver-linux-amd64": sum}, true},
+		{"binary mode", sum + " *mcpeserver\n", map[string]string{"mcpeserver": sum}, true},
+		{"name with spaces", sum + "  server build (1).zip\n", map[string]string{"server build (1).zip": sum}, true},
+		{"binary name with spaces", sum + " *my server\n", map[string]string{"my server": sum}, true},
+		{"tab separated", sum + "\tmcpeserver\n", map[string]string{"mcpeserver": sum}, true},
+		{"comments and blank lines", "# sums\n\n" + sum + "  a\n" + strings.ToUpper(sum) + "  b\n", map[string]string{"a": sum, "b": sum}, true},
+		{"missing name", sum + "\n", nil, false},
+		{"only star", sum + " *\n", nil, false},
+		{"short sum", "abcd  mcpeserver\n", nil, false},
+		{"not hex", strings.Repeat("zz", 32) + "  mcpeserver\n", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseChecksums([]byte(test.data))
+			if (err == nil) != test.valid {
+				t.Fatalf("error %v, want valid=%v", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d entries, want %d", len(got), len(test.want))
+			}
+			for name, want := range test.want {
+				if hex.EncodeToString(got[name]) != want {
+					t.Errorf("%q: got %x, want %s", name, got[name], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+)
+
+// watchdogOptions configures hang detection; an interval of 0 turns it off
+type watchdogOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+	misses   int
+	grace    time.Duration
+}
+
+// watchdogState is shared between the watchdog of the current run and the systemd keepalive
+type watchdogState struct {
+	misses int32
+	hung   int32
+}
+
+func (s *watchdogState) healthy() bool {
+	return atomic.LoadInt32(&s.misses) == 0
+}
+
+// systemdWatchdog resolves the watchdog interval, deriving it from WatchdogSec= when not given,
+// and returns how often systemd wants to hear from us (0 if it does not)
+func (opts *watchdogOptions) systemdWatchdog() time.Duration {
+	usec, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		printWarn(fmt.Sprintf("Ignoring the systemd watchdog: %v", err))
+		return 0
+	}
+	if usec > 0 && opts.interval == 0 {
+		// leave room for every allowed miss before systemd gives up on us
+		opts.interval = usec / time.Duration(opts.misses+1)
+		if opts.interval < time.Second {
+			opts.interval = time.Second
+		}
+		if opts.timeout > opts.interval {
+			opts.timeout = opts.interval
+		}
+	}
+	return usec / 2
+}
+
+// keepAlive tells systemd we are alive for as long as the server answers, until quit is closed
+func keepAlive(every time.Duration, state *watchdogState, quit <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if state.healthy() {
+				daemon.SdNotify(false, daemon.SdNotifyWatchdog)
+			}
+		}
+	}
+}
+
+// dumpThreads writes the kernel's view of every thread of a hung process to <profile>.hang-<time>.txt
+func dumpThreads(profile string, pid int) string {
+	file := fmt.Sprintf("%s.hang-%s.txt", profile, time.Now().Format("20060102-150405"))
+	var out strings.Builder
+	fmt.Fprintf(&out, "pid %d, captured %s\n", pid, time.Now().Format(time.RFC3339))
+	// in the sandbox pid is the init, the server is one of its children
+	for pids := []int{pid}; len(pids) > 0; pids = pids[1:] {
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*", pids[0]))
+		sort.Strings(tasks)
+		for _, task := range tasks {
+			fmt.Fprintf(&out, "\n=== pid %d thread %s ===\n", pids[0], filepath.Base(task))
+			for _, name := range []string{"status", "wchan", "stack"} {
+				data, err := ioutil.ReadFile(filepath.Join(task, name))
+				if err != nil {
+					fmt.Fprintf(&out, "--- %s: %v\n", name, err)
+					continue
+				}
+				fmt.Fprintf(&out, "--- %s\n%s\n", name, strings.TrimRight(string(data), "\n"))
+			}
+			children, _ := ioutil.ReadFile(filepath.Join(task, "children"))
+			for _, child := range strings.Fields(string(children)) {
+				if n, err := strconv.Atoi(child); err == nil {
+					pids = append(pids, n)
+				}
+			}
+		}
+	}
+	if err := ioutil.WriteFile(file, []byte(out.String()), 0644); err != nil {
+		printWarn(fmt.Sprintf("Failed to write %s: %v", file, err))
+	}
+	return file
+}
+
+// watchdog pings the server every interval until exited is closed; after opts.misses missed pings
+// in a row it captures diagnostics and kills the server so the supervisor starts it again
+func watchdog(profile string, b *bus, process *os.Process, opts watchdogOptions, state *watchdogState, exited <-chan struct{}) {
+	atomic.StoreInt32(&state.misses, 0)
+	atomic.StoreInt32(&state.hung, 0)
+	start := time.Now()
+	answered := false
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-ticker.C:
+		}
+		err := errPingTimeout
+		if b.conn == nil {
+			err = b.dial(profile)
+		}
+		if b.conn != nil {
+			_, err = b.pingWithin(opts.timeout)
+		}
+		// the connection itself may be what failed, as after a restart of the bus daemon;
+		// a ping that timed out went through, so only the server is to blame for it
+		if err != nil && err != errPingTimeout && b.conn != nil {
+			if derr := b.redial(profile); derr != nil {
+				err = fmt.Errorf("%v (reconnecting: %v)", err, derr)
+			} else {
+				_, err = b.pingWithin(opts.timeout)
+			}
+		}
+		if err == nil {
+			answered = true
+			atomic.StoreInt32(&state.misses, 0)
+			continue
+		}
+		// a server that is still loading its world does not answer yet
+		if !answered && time.Since(start) < opts.grace {
+			continue
+		}
+		misses := atomic.AddInt32(&state.misses, 1)
+		logEvent(profile, "watchdog: ping %d/%d failed: %v", misses, opts.misses, err)
+		if int(misses) < opts.misses {
+			continue
+		}
+		file := dumpThreads(profile, process.Pid)
+		logEvent(profile, "watchdog: server is hung, thread dump in %s, restarting", file)
+		printWarn(fmt.Sprintf("Server is hung, thread dump in %s", file))
+		atomic.StoreInt32(&state.hung, 1)
+		process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			process.Kill()
+		}
+		return
+	}
+}